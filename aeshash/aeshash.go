@@ -58,4 +58,13 @@ func (aesh *AESHasher) Hash_uint64(input *[16]byte) uint64 {
     aesh.hasher.Encrypt(aesh.output, (*input)[:])
     return binary.LittleEndian.Uint64(aesh.output)
 
-}
\ No newline at end of file
+}
+
+//---------------------------------------------------
+// Use AES encryption as a hash function on an input,
+//  returning the whole cipher block
+func (aesh *AESHasher) Hash_block(input *[16]byte) [16]byte {
+    var output [16]byte
+    aesh.hasher.Encrypt(output[:], (*input)[:])
+    return output
+}
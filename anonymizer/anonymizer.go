@@ -0,0 +1,399 @@
+// Command anonymizer rewrites the addresses in a packet trace with the
+// prefix-preserving Crypto-PAn scheme so that traces can be shared.
+//
+// usage: anonymizer -key <key file> [-format pcap|binary|txt]
+//                   [-keep-ports=false] [-keep-proto=false] <input> <output>
+//
+// The key file holds the 32 byte Crypto-PAn key, either raw or as 64 hex
+// characters. The same key always gives the same mapping, so traces
+// anonymised separately can still be correlated. Compressed input is read
+// transparently, the output is always uncompressed.
+package main
+
+import (
+    "bufio"
+    "encoding/binary"
+    "encoding/hex"
+    "flag"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "strconv"
+    "strings"
+
+    "github.com/google/gopacket"
+    "github.com/google/gopacket/layers"
+    "github.com/google/gopacket/pcapgo"
+
+    "github.com/hosslen/lfd/caida"
+    "github.com/hosslen/lfd/cryptopan"
+)
+
+const (
+    ETHERTYPE_IPV4 = 0x0800
+    ETHERTYPE_IPV6 = 0x86dd
+    ETHERTYPE_VLAN = 0x8100
+    ETHERTYPE_QINQ = 0x88a8
+    //written in place of the protocol when it is not kept, in every trace
+    //format; 0 would be read as an IPv6 hop-by-hop header, 255 is reserved
+    SCRUBBED_PROTO = 255
+)
+
+//---------------------------------------------------
+// Anonymiser with an address cache, traces repeat addresses a lot and every
+// address costs one AES encryption per bit
+type anonymizer struct {
+    cp *cryptopan.CryptoPAn
+    keepPorts bool
+    keepProto bool
+    cache4 map[uint32]uint32
+    cache6 map[[16]byte][16]byte
+}
+
+func (a *anonymizer) ipv4(addr uint32) uint32 {
+    anon, ok := a.cache4[addr]
+    if !ok {
+        anon = a.cp.AnonymizeIPv4(addr)
+        a.cache4[addr] = anon
+    }
+    return anon
+}
+
+//anonymises the 4 or 16 byte address in place
+func (a *anonymizer) addr(b []byte) {
+    if len(b) == 4 {
+        binary.BigEndian.PutUint32(b, a.ipv4(binary.BigEndian.Uint32(b)))
+        return
+    }
+    var addr [16]byte
+    copy(addr[:], b)
+    anon, ok := a.cache6[addr]
+    if !ok {
+        copy(anon[:], a.cp.Anonymize(addr[:]))
+        a.cache6[addr] = anon
+    }
+    copy(b, anon[:])
+}
+
+//reads a raw or hex encoded key
+func readKey(filename string) ([]byte, error) {
+    key, err := ioutil.ReadFile(filename)
+    if err != nil {
+        return nil, err
+    }
+    if len(key) == cryptopan.KeySize {
+        return key, nil
+    }
+    key, err = hex.DecodeString(strings.TrimSpace(string(key)))
+    if err != nil || len(key) != cryptopan.KeySize {
+        return nil, fmt.Errorf("%s: key must be %d raw bytes or %d hex digits",
+            filename, cryptopan.KeySize, 2*cryptopan.KeySize)
+    }
+    return key, nil
+}
+
+//updates an internet checksum for a change of old to new (RFC 1624),
+//old and new have the same even length and are 16-bit aligned in the sum
+func adjustChecksum(sum uint16, old []byte, new []byte) uint16 {
+    s := uint32(^sum)
+    for i := 0; i + 1 < len(old); i += 2 {
+        s += uint32(^binary.BigEndian.Uint16(old[i:]))
+        s += uint32(binary.BigEndian.Uint16(new[i:]))
+    }
+    for s >> 16 != 0 {
+        s = s & 0xffff + s >> 16
+    }
+    return ^uint16(s)
+}
+
+//anonymises the transport header at l4 and fixes its checksum for the
+//changes in the pseudo header (addresses and protocol)
+func (a *anonymizer) transport(l4 []byte, proto byte,
+        oldPseudo []byte, newPseudo []byte) {
+    var csumOff int
+    switch proto {
+    case 6:
+        csumOff = 16
+    case 17:
+        csumOff = 6
+    default:
+        return
+    }
+    if len(l4) < 4 {
+        return
+    }
+    oldPorts := make([]byte, 4)
+    copy(oldPorts, l4[:4])
+    if !a.keepPorts {
+        copy(l4[:4], []byte{0, 0, 0, 0})
+    }
+    if len(l4) < csumOff + 2 {
+        return
+    }
+    sum := binary.BigEndian.Uint16(l4[csumOff:])
+    if proto == 17 && sum == 0 {
+        //no UDP checksum
+        return
+    }
+    sum = adjustChecksum(sum, oldPseudo, newPseudo)
+    sum = adjustChecksum(sum, oldPorts, l4[:4])
+    if proto == 17 && sum == 0 {
+        sum = 0xffff
+    }
+    binary.BigEndian.PutUint16(l4[csumOff:], sum)
+}
+
+func (a *anonymizer) ipv4Packet(ip []byte) bool {
+    if len(ip) < 20 || ip[0] >> 4 != 4 {
+        return false
+    }
+    ihl := int(ip[0] & 0xf)*4
+    old := make([]byte, 20)
+    copy(old, ip[:20])
+
+    a.addr(ip[12:16])
+    a.addr(ip[16:20])
+    proto := ip[9]
+    if !a.keepProto {
+        ip[9] = SCRUBBED_PROTO
+    }
+    sum := binary.BigEndian.Uint16(ip[10:])
+    sum = adjustChecksum(sum, old[8:10], ip[8:10])
+    sum = adjustChecksum(sum, old[12:20], ip[12:20])
+    binary.BigEndian.PutUint16(ip[10:], sum)
+
+    //only the first fragment carries the transport header
+    if binary.BigEndian.Uint16(ip[6:]) & 0x1fff != 0 || len(ip) < ihl {
+        return true
+    }
+    oldPseudo := append(old[12:20:20], 0, old[9])
+    newPseudo := append(append([]byte{}, ip[12:20]...), 0, ip[9])
+    a.transport(ip[ihl:], proto, oldPseudo, newPseudo)
+    return true
+}
+
+func (a *anonymizer) ipv6Packet(ip []byte) bool {
+    if len(ip) < 40 || ip[0] >> 4 != 6 {
+        return false
+    }
+    old := make([]byte, 40)
+    copy(old, ip[:40])
+
+    a.addr(ip[8:24])
+    a.addr(ip[24:40])
+    proto := ip[6]
+    if !a.keepProto {
+        ip[6] = SCRUBBED_PROTO
+    }
+    //extension headers are not followed
+    oldPseudo := append(old[8:40:40], 0, old[6])
+    newPseudo := append(append([]byte{}, ip[8:40]...), 0, ip[6])
+    a.transport(ip[40:], proto, oldPseudo, newPseudo)
+    return true
+}
+
+//anonymises the packet in place, returns false if it contains no IP packet
+//that could be anonymised
+func (a *anonymizer) packet(data []byte, linkType layers.LinkType) bool {
+    var etherType uint16
+    var ip []byte
+    switch linkType {
+    case layers.LinkTypeEthernet:
+        if len(data) < 14 {
+            return false
+        }
+        etherType = binary.BigEndian.Uint16(data[12:])
+        ip = data[14:]
+        for (etherType == ETHERTYPE_VLAN || etherType == ETHERTYPE_QINQ) &&
+                len(ip) >= 4 {
+            etherType = binary.BigEndian.Uint16(ip[2:])
+            ip = ip[4:]
+        }
+    case layers.LinkTypeLinuxSLL:
+        if len(data) < 16 {
+            return false
+        }
+        etherType = binary.BigEndian.Uint16(data[14:])
+        ip = data[16:]
+    case layers.LinkTypeRaw, layers.LinkTypeIPv4, layers.LinkTypeIPv6, 12:
+        //the caida traces use link type 12 for raw IP
+        if len(data) < 1 {
+            return false
+        }
+        ip = data
+        switch data[0] >> 4 {
+        case 4:
+            etherType = ETHERTYPE_IPV4
+        case 6:
+            etherType = ETHERTYPE_IPV6
+        }
+    default:
+        return false
+    }
+    switch etherType {
+    case ETHERTYPE_IPV4:
+        return a.ipv4Packet(ip)
+    case ETHERTYPE_IPV6:
+        return a.ipv6Packet(ip)
+    }
+    return false
+}
+
+//anonymises a pcap trace. Packets that cannot be anonymised are written
+//zeroed out rather than dropped, so that every packet keeps its place and
+//the .times file of the trace still lines up with it.
+func (a *anonymizer) pcap(in io.Reader, out io.Writer) (int, int, error) {
+    reader, err := pcapgo.NewReader(in)
+    if err != nil {
+        return 0, 0, err
+    }
+    var writer *pcapgo.Writer
+    if reader.Resolution() == gopacket.TimestampResolutionNanosecond {
+        writer = pcapgo.NewWriterNanos(out)
+    } else {
+        writer = pcapgo.NewWriter(out)
+    }
+    err = writer.WriteFileHeader(reader.Snaplen(), reader.LinkType())
+    if err != nil {
+        return 0, 0, err
+    }
+    written, scrubbed := 0, 0
+    for {
+        data, ci, err := reader.ReadPacketData()
+        if err == io.EOF {
+            break
+        } else if err != nil {
+            return written, scrubbed, err
+        }
+        if !a.packet(data, reader.LinkType()) {
+            for i := range data {
+                data[i] = 0
+            }
+            scrubbed++
+        } else {
+            written++
+        }
+        if err = writer.WritePacket(ci, data); err != nil {
+            return written, scrubbed, err
+        }
+    }
+    return written, scrubbed, nil
+}
+
+//anonymises a binary trace of little-endian CaidaPkt records
+func (a *anonymizer) binary(in io.Reader, out io.Writer) (int, int, error) {
+    written := 0
+    for {
+        pkt := &caida.CaidaPkt{}
+        err := binary.Read(in, binary.LittleEndian, pkt)
+        if err == io.EOF {
+            break
+        } else if err != nil {
+            return written, 0, err
+        }
+        a.addr(pkt.Id[0:4])
+        a.addr(pkt.Id[4:8])
+        if !a.keepProto {
+            pkt.Id[8] = SCRUBBED_PROTO
+        }
+        if !a.keepPorts {
+            copy(pkt.Id[9:13], []byte{0, 0, 0, 0})
+        }
+        if err = binary.Write(out, binary.LittleEndian, pkt); err != nil {
+            return written, 0, err
+        }
+        written++
+    }
+    return written, 0, nil
+}
+
+//anonymises a text trace, the flow id of each "flowId size time" line is
+//treated as an IPv4 address; ports and protocol do not appear in it
+func (a *anonymizer) txt(in io.Reader, out io.Writer) (int, int, error) {
+    written, dropped := 0, 0
+    scanner := bufio.NewScanner(in)
+    for scanner.Scan() {
+        strs := strings.SplitN(scanner.Text(), " ", 2)
+        flowId, err := strconv.ParseUint(strs[0], 10, 32)
+        if err != nil || len(strs) != 2 {
+            dropped++
+            continue
+        }
+        _, err = fmt.Fprintf(out, "%d %s\n", a.ipv4(uint32(flowId)), strs[1])
+        if err != nil {
+            return written, dropped, err
+        }
+        written++
+    }
+    return written, dropped, scanner.Err()
+}
+
+func main() {
+    keyFile := flag.String("key", "", "file holding the Crypto-PAn key")
+    format := flag.String("format", "pcap", "trace format: pcap, binary or txt")
+    keepPorts := flag.Bool("keep-ports", true, "keep the port numbers")
+    keepProto := flag.Bool("keep-proto", true, "keep the protocol number")
+    flag.Parse()
+    if *keyFile == "" || flag.NArg() != 2 {
+        fmt.Printf("usage: %s -key <key file> [options] <input> <output>\n",
+            os.Args[0])
+        flag.PrintDefaults()
+        os.Exit(1)
+    }
+
+    key, err := readKey(*keyFile)
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+    cp, err := cryptopan.NewCryptoPAn(key)
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+    a := &anonymizer{cp, *keepPorts, *keepProto,
+        make(map[uint32]uint32), make(map[[16]byte][16]byte)}
+
+    var run func(io.Reader, io.Writer) (int, int, error)
+    switch *format {
+    case "pcap":
+        run = a.pcap
+    case "binary":
+        run = a.binary
+    case "txt":
+        run = a.txt
+    default:
+        fmt.Printf("unknown trace format %q\n", *format)
+        os.Exit(1)
+    }
+
+    in, err := caida.OpenTraceFile(flag.Arg(0))
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+    defer in.Close()
+    outFile, err := os.Create(flag.Arg(1))
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+    out := bufio.NewWriterSize(outFile, 1 << 16)
+
+    written, dropped, err := run(in, out)
+    if err == nil {
+        err = out.Flush()
+    }
+    if cErr := outFile.Close(); err == nil {
+        err = cErr
+    }
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+    //pcap traces keep the packets that could not be anonymised, zeroed out
+    fmt.Printf("anonymised %d packets, dropped or zeroed %d packets\n",
+        written, dropped)
+    fmt.Printf("%d IPv4 and %d IPv6 addresses\n", len(a.cache4), len(a.cache6))
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "io"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/google/gopacket"
+    "github.com/google/gopacket/layers"
+    "github.com/google/gopacket/pcapgo"
+
+    "github.com/hosslen/lfd/caida"
+    "github.com/hosslen/lfd/cryptopan"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func newTestAnonymizer(t *testing.T, keepPorts, keepProto bool) *anonymizer {
+    cp, err := cryptopan.NewCryptoPAn(testKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return &anonymizer{cp, keepPorts, keepProto,
+        make(map[uint32]uint32), make(map[[16]byte][16]byte)}
+}
+
+//one's complement sum of parts, 0xffff over a packet with a valid checksum
+func inetSum(parts ...[]byte) uint16 {
+    var s uint32
+    for _, b := range parts {
+        for i := 0; i < len(b); i += 2 {
+            if i + 1 < len(b) {
+                s += uint32(binary.BigEndian.Uint16(b[i:]))
+            } else {
+                s += uint32(b[i]) << 8
+            }
+        }
+    }
+    for s >> 16 != 0 {
+        s = s & 0xffff + s >> 16
+    }
+    return uint16(s)
+}
+
+//transport header and 4 bytes of payload with a valid checksum
+func transportSegment(proto byte, pseudo []byte) []byte {
+    var l4 []byte
+    csumOff := 16
+    if proto == 6 {
+        l4 = make([]byte, 24)
+        l4[12] = 5 << 4
+    } else {
+        l4 = make([]byte, 12)
+        binary.BigEndian.PutUint16(l4[4:], uint16(len(l4)))
+        csumOff = 6
+    }
+    binary.BigEndian.PutUint16(l4[0:], 1234)
+    binary.BigEndian.PutUint16(l4[2:], 80)
+    copy(l4[len(l4) - 4:], "data")
+    length := []byte{0, 0}
+    binary.BigEndian.PutUint16(length, uint16(len(l4)))
+    binary.BigEndian.PutUint16(l4[csumOff:],
+        ^inetSum(pseudo, []byte{0, proto}, length, l4))
+    return l4
+}
+
+func ipv4Packet(proto byte) []byte {
+    ip := make([]byte, 20)
+    ip[0] = 0x45
+    ip[8] = 64
+    ip[9] = proto
+    copy(ip[12:16], []byte{10, 0, 0, 1})
+    copy(ip[16:20], []byte{192, 168, 1, 2})
+    ip = append(ip, transportSegment(proto, ip[12:20])...)
+    binary.BigEndian.PutUint16(ip[2:], uint16(len(ip)))
+    binary.BigEndian.PutUint16(ip[10:], ^inetSum(ip[:20]))
+    return ip
+}
+
+func ipv6Packet(proto byte) []byte {
+    ip := make([]byte, 40)
+    ip[0] = 0x60
+    ip[6] = proto
+    ip[7] = 64
+    ip[8], ip[9], ip[23] = 0x20, 0x01, 1
+    ip[24], ip[25], ip[39] = 0x20, 0x01, 2
+    ip = append(ip, transportSegment(proto, ip[8:40])...)
+    binary.BigEndian.PutUint16(ip[4:], uint16(len(ip) - 40))
+    return ip
+}
+
+//checks the checksums of an IP packet with a transport header
+func checkChecksums(t *testing.T, name string, ip []byte) {
+    var pseudo, l4 []byte
+    var proto byte
+    if ip[0] >> 4 == 4 {
+        if inetSum(ip[:20]) != 0xffff {
+            t.Errorf("%s: invalid IPv4 header checksum", name)
+        }
+        pseudo, proto, l4 = ip[12:20], ip[9], ip[20:]
+    } else {
+        pseudo, proto, l4 = ip[8:40], ip[6], ip[40:]
+    }
+    length := []byte{0, 0}
+    binary.BigEndian.PutUint16(length, uint16(len(l4)))
+    if inetSum(pseudo, []byte{0, proto}, length, l4) != 0xffff {
+        t.Errorf("%s: invalid transport checksum", name)
+    }
+}
+
+//the checksums stay valid whatever is anonymised
+func TestChecksumFixup(t *testing.T) {
+    for _, keep := range [][2]bool{
+            {true, true}, {false, true}, {true, false}, {false, false}} {
+        a := newTestAnonymizer(t, keep[0], keep[1])
+        for _, test := range []struct{
+            name string
+            ip []byte
+        }{
+            {"IPv4/TCP", ipv4Packet(6)},
+            {"IPv4/UDP", ipv4Packet(17)},
+            {"IPv6/TCP", ipv6Packet(6)},
+            {"IPv6/UDP", ipv6Packet(17)},
+        } {
+            orig := append([]byte{}, test.ip...)
+            if !a.packet(test.ip, layers.LinkTypeRaw) {
+                t.Errorf("%s: not anonymised", test.name)
+                continue
+            }
+            checkChecksums(t, test.name, test.ip)
+            hdrLen, protoOff := 20, 9
+            if test.ip[0] >> 4 == 6 {
+                hdrLen, protoOff = 40, 6
+            }
+            if bytes.Equal(orig[hdrLen - 8:hdrLen], test.ip[hdrLen - 8:hdrLen]) {
+                t.Errorf("%s: destination address not anonymised", test.name)
+            }
+            if (test.ip[protoOff] == SCRUBBED_PROTO) == keep[1] {
+                t.Errorf("%s, keep proto %v: protocol is %d", test.name,
+                    keep[1], test.ip[protoOff])
+            }
+            ports := test.ip[hdrLen:hdrLen + 4]
+            if bytes.Equal(ports, orig[hdrLen:hdrLen + 4]) != keep[0] {
+                t.Errorf("%s, keep ports %v: ports are %v", test.name,
+                    keep[0], ports)
+            }
+        }
+    }
+
+    //a UDP packet without checksum keeps none
+    a := newTestAnonymizer(t, false, false)
+    ip := ipv4Packet(17)
+    binary.BigEndian.PutUint16(ip[26:], 0)
+    a.packet(ip, layers.LinkTypeRaw)
+    if binary.BigEndian.Uint16(ip[26:]) != 0 {
+        t.Errorf("UDP checksum added to a packet without one")
+    }
+}
+
+//flow ids are anonymised as IPv4 addresses, malformed lines are dropped
+func TestTxt(t *testing.T) {
+    a := newTestAnonymizer(t, true, true)
+    in := strings.NewReader("167772161 1500 0.1\nnot a flow id\n3232235778 40 0.2\n")
+    out := &bytes.Buffer{}
+    written, dropped, err := a.txt(in, out)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if written != 2 || dropped != 1 {
+        t.Errorf("%d lines written, %d dropped, expected 2 and 1",
+            written, dropped)
+    }
+    want := ""
+    for _, line := range []struct{
+        addr uint32
+        rest string
+    }{{167772161, "1500 0.1"}, {3232235778, "40 0.2"}} {
+        anon := uint64(a.cp.AnonymizeIPv4(line.addr))
+        want += strconv.FormatUint(anon, 10) + " " + line.rest + "\n"
+    }
+    if out.String() != want {
+        t.Errorf("output %q, expected %q", out.String(), want)
+    }
+}
+
+//binary records keep their time and size, ports and protocol are scrubbed
+//like in pcap traces
+func TestBinary(t *testing.T) {
+    a := newTestAnonymizer(t, false, false)
+    pkts := []caida.CaidaPkt{
+        {Duration: time.Second, Size: 1500,
+            Id: [16]byte{10, 0, 0, 1, 10, 0, 0, 2, 6, 4, 210, 0, 80}},
+        {Duration: 2*time.Second, Size: 40,
+            Id: [16]byte{10, 0, 0, 2, 10, 0, 0, 1, 17, 0, 53, 0, 53}},
+    }
+    in := &bytes.Buffer{}
+    for i := range pkts {
+        binary.Write(in, binary.LittleEndian, &pkts[i])
+    }
+    out := &bytes.Buffer{}
+    written, _, err := a.binary(in, out)
+    if err != nil || written != len(pkts) {
+        t.Fatalf("%d records written, %v", written, err)
+    }
+    for _, orig := range pkts {
+        var pkt caida.CaidaPkt
+        if err := binary.Read(out, binary.LittleEndian, &pkt); err != nil {
+            t.Fatal(err)
+        }
+        if pkt.Duration != orig.Duration || pkt.Size != orig.Size {
+            t.Errorf("record at %v with %dB, expected %v and %dB",
+                pkt.Duration, pkt.Size, orig.Duration, orig.Size)
+        }
+        src := binary.BigEndian.Uint32(orig.Id[0:4])
+        if binary.BigEndian.Uint32(pkt.Id[0:4]) != a.cp.AnonymizeIPv4(src) {
+            t.Errorf("source address not anonymised")
+        }
+        if pkt.Id[8] != SCRUBBED_PROTO {
+            t.Errorf("protocol is %d, expected %d", pkt.Id[8], SCRUBBED_PROTO)
+        }
+        if !bytes.Equal(pkt.Id[9:13], []byte{0, 0, 0, 0}) {
+            t.Errorf("ports are %v, expected zero", pkt.Id[9:13])
+        }
+    }
+}
+
+//every packet of a pcap trace keeps its place, so that the .times file
+//still lines up; the ones that cannot be anonymised are zeroed out
+func TestPcap(t *testing.T) {
+    a := newTestAnonymizer(t, true, true)
+    ether := func(etherType uint16, payload []byte) []byte {
+        frame := make([]byte, 14)
+        binary.BigEndian.PutUint16(frame[12:], etherType)
+        return append(frame, payload...)
+    }
+    frames := [][]byte{
+        ether(ETHERTYPE_IPV4, ipv4Packet(6)),
+        //ARP
+        ether(0x0806, []byte("not an ip packet")),
+        ether(ETHERTYPE_IPV6, ipv6Packet(17)),
+    }
+    in := &bytes.Buffer{}
+    w := pcapgo.NewWriter(in)
+    w.WriteFileHeader(65535, layers.LinkTypeEthernet)
+    for i, f := range frames {
+        ci := gopacket.CaptureInfo{Timestamp: time.Unix(int64(i), 0),
+            CaptureLength: len(f), Length: len(f)}
+        if err := w.WritePacket(ci, f); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    out := &bytes.Buffer{}
+    written, scrubbed, err := a.pcap(in, out)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if written != 2 || scrubbed != 1 {
+        t.Errorf("%d packets anonymised, %d zeroed, expected 2 and 1",
+            written, scrubbed)
+    }
+    r, err := pcapgo.NewReader(out)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i, f := range frames {
+        data, ci, err := r.ReadPacketData()
+        if err != nil {
+            t.Fatalf("packet %d: %v", i, err)
+        }
+        if ci.Timestamp.Unix() != int64(i) || len(data) != len(f) {
+            t.Errorf("packet %d at %v with %dB, expected %d and %dB",
+                i, ci.Timestamp, len(data), i, len(f))
+        }
+        if i == 1 {
+            if !bytes.Equal(data, make([]byte, len(f))) {
+                t.Errorf("packet that cannot be anonymised not zeroed")
+            }
+            continue
+        }
+        checkChecksums(t, "pcap", data[14:])
+    }
+    if _, _, err := r.ReadPacketData(); err != io.EOF {
+        t.Errorf("more packets than written: %v", err)
+    }
+}
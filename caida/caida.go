@@ -4,15 +4,22 @@ package caida
 import (
     "encoding/binary"
     "fmt"
+    "io"
     "os"
     "time"
     "bufio"
+    "bytes"
+    "sort"
     "strings"
     "strconv"
+    "path/filepath"
+    "compress/bzip2"
+    "compress/gzip"
 
     "github.com/google/gopacket"
     "github.com/google/gopacket/layers"
     "github.com/google/gopacket/pcap"
+    "github.com/google/gopacket/pcapgo"
 
     "github.com/hosslen/lfd/eardet"
     "github.com/hosslen/lfd/murmur3"
@@ -23,8 +30,28 @@ type TraceData struct {
     PacketsInitialized bool
     PacketCounter int
     ErrCounter int
+    //packets removed by the BPF filter before conversion
+    FilteredCounter int
+    //packets dropped because they lie before the packet preceding them
+    OutOfOrderCounter int
     TcpCounter int
     UdpCounter int
+    //per-file statistics, one entry per pcap file that was read
+    Files []FileStats
+}
+
+//statistics of one pcap/times file pair of a trace
+type FileStats struct {
+    PcapFilename string
+    TimesFilename string
+    PacketCounter int
+    ErrCounter int
+    FilteredCounter int
+    //packets dropped because they lie before the packet preceding them
+    OutOfOrderCounter int
+    //the file was skipped because its first timestamp lies before the
+    //last timestamp of the previous file
+    Rejected bool
 }
 
 type packetHandler func(packet gopacket.Packet, pktTime time.Duration) bool
@@ -44,6 +71,7 @@ func newTraceData(maxNumPkts int) *TraceData {
     trace.PacketsInitialized = false
     trace.PacketCounter = 0
     trace.ErrCounter = 0
+    trace.FilteredCounter = 0
     trace.TcpCounter = 0
     trace.UdpCounter = 0
     return trace
@@ -53,17 +81,133 @@ func newTraceData(maxNumPkts int) *TraceData {
 func printCounters(trace *TraceData) {
     fmt.Printf("Total number of packets: %d\n", trace.PacketCounter)
     fmt.Printf("Total number of errors: %d\n", trace.ErrCounter)
+    fmt.Printf("Number of packets removed by BPF filter: %d\n",
+        trace.FilteredCounter)
+    fmt.Printf("Number of packets dropped for going back in time: %d\n",
+        trace.OutOfOrderCounter)
     fmt.Printf("Number of TCP over IPv4 packets: %d\n", trace.TcpCounter)
     fmt.Printf("Number of UDP over IPv4 packets: %d\n", trace.UdpCounter)
+    if len(trace.Files) > 1 {
+        for _, f := range trace.Files {
+            if f.Rejected {
+                fmt.Printf("  %s: rejected, timestamps go backwards\n",
+                    f.PcapFilename)
+                continue
+            }
+            fmt.Printf("  %s: %d packets, %d errors, %d filtered, " +
+                "%d out of order\n", f.PcapFilename, f.PacketCounter,
+                f.ErrCounter, f.FilteredCounter, f.OutOfOrderCounter)
+        }
+    }
+}
+
+var (
+    gzipMagic = []byte{0x1f, 0x8b}
+    bzip2Magic = []byte("BZh")
+    //section header block of a pcapng file
+    pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+)
+
+//DLT_RAW, the value libpcap uses in place of LINKTYPE_RAW (101) when it
+//opens a file
+const dltRaw = layers.LinkType(12)
+
+//reads the packets of a pcap or pcapng file
+type packetReader interface {
+    gopacket.PacketDataSource
+    LinkType() layers.LinkType
+}
+
+//opens a pcap or pcapng reader on r, returns it with its snap length
+func newPcapReader(r io.Reader) (packetReader, int, error) {
+    br := bufio.NewReader(r)
+    magic, _ := br.Peek(len(pcapngMagic))
+    if bytes.Equal(magic, pcapngMagic) {
+        ng, err := pcapgo.NewNgReader(br, pcapgo.DefaultNgReaderOptions)
+        if err != nil {
+            return nil, 0, err
+        }
+        snaplen := 0
+        if intf, err := ng.Interface(0); err == nil {
+            snaplen = int(intf.SnapLength)
+        }
+        return ng, snaplen, nil
+    }
+    pr, err := pcapgo.NewReader(br)
+    if err != nil {
+        return nil, 0, err
+    }
+    return pr, int(pr.Snaplen()), nil
+}
+
+//the link type of a file as the DLT value libpcap expects, which differs
+//for raw IP
+func dltOf(linkType layers.LinkType) layers.LinkType {
+    if linkType == layers.LinkTypeRaw {
+        return dltRaw
+    }
+    return linkType
+}
+
+//closes the decompressor (if any) and the underlying file
+type traceFile struct {
+    io.Reader
+    closers []io.Closer
+}
+
+func (tf *traceFile) Close() error {
+    var err error
+    for _, c := range tf.closers {
+        if cErr := c.Close(); cErr != nil && err == nil {
+            err = cErr
+        }
+    }
+    return err
+}
+
+//opens a trace file (pcap, times, txt or binary) for streaming reads.
+//gzip- and bzip2-compressed files are detected by their magic bytes and
+//decompressed on the fly, so the file name does not matter.
+func OpenTraceFile(filename string) (io.ReadCloser, error) {
+    f, err := os.Open(filename)
+    if err != nil {
+        return nil, err
+    }
+    br := bufio.NewReaderSize(f, 1 << 16)
+    magic, _ := br.Peek(len(bzip2Magic))
+
+    switch {
+    case bytes.HasPrefix(magic, gzipMagic):
+        gr, err := gzip.NewReader(br)
+        if err != nil {
+            f.Close()
+            return nil, fmt.Errorf("%s: %v", filename, err)
+        }
+        return &traceFile{gr, []io.Closer{gr, f}}, nil
+    case bytes.HasPrefix(magic, bzip2Magic):
+        return &traceFile{bzip2.NewReader(br), []io.Closer{f}}, nil
+    }
+    return &traceFile{br, []io.Closer{f}}, nil
 }
 
 //loops over all packets in the pcap file
 // timesFilename is the path of the file containing nanosecond timestamps
 // for each packet. 
+// bpfFilter is a tcpdump-style filter expression; packets that do not match
+// it are skipped (their timestamps are consumed nonetheless). An empty
+// filter keeps all packets. Returns the number of skipped packets.
 func loopOverPCAPFile(
-        pcapFilename string, timesFilename string, myHandler packetHandler) {
-    pcapHandle, pcapErr := pcap.OpenOffline(pcapFilename);
-    timesHandle, timesErr := os.Open(timesFilename);
+        pcapFilename string, timesFilename string, bpfFilter string,
+        myHandler packetHandler) int {
+    pcapFile, pcapErr := OpenTraceFile(pcapFilename);
+    timesHandle, timesErr := OpenTraceFile(timesFilename);
+    filtered := 0
+
+    var pcapReader packetReader
+    var snaplen int
+    if pcapErr == nil {
+        pcapReader, snaplen, pcapErr = newPcapReader(pcapFile)
+    }
 
     if pcapErr != nil {
         fmt.Printf("Failed to open pcap file: %v\n", pcapErr)
@@ -72,13 +216,27 @@ func loopOverPCAPFile(
         fmt.Printf("Failed to open times file: %v\n", timesErr)
         os.Exit(1)
     } else {
+        linkType := dltOf(pcapReader.LinkType())
+        if snaplen == 0 {
+            snaplen = 65535
+        }
+        var bpf *pcap.BPF
+        if bpfFilter != "" {
+            var bpfErr error
+            bpf, bpfErr = pcap.NewBPF(linkType, snaplen, bpfFilter)
+            if bpfErr != nil {
+                fmt.Printf("Failed to compile BPF filter %q: %v\n",
+                    bpfFilter, bpfErr)
+                os.Exit(1)
+            }
+        }
         var decoder gopacket.Decoder
-        if pcapHandle.LinkType() == 12 {
+        if linkType == dltRaw {
             decoder = layers.LayerTypeIPv4
         } else {
-            decoder = pcapHandle.LinkType()
+            decoder = linkType
         }
-        packetSource := gopacket.NewPacketSource(pcapHandle, decoder)
+        packetSource := gopacket.NewPacketSource(pcapReader, decoder)
         timesScanner := bufio.NewScanner(timesHandle)
         for packet := range packetSource.Packets() {
             if !timesScanner.Scan() {
@@ -87,12 +245,19 @@ func loopOverPCAPFile(
                     "than packets\n")
                 os.Exit(1)
             }
+            if bpf != nil &&
+                !bpf.Matches(packet.Metadata().CaptureInfo, packet.Data()) {
+                filtered++
+                continue
+            }
             // timestamp with precision of nanosecond
             pktTime, _ := time.ParseDuration(timesScanner.Text() + "s")
             if !myHandler(packet, pktTime) {break}
         }
         timesHandle.Close()
+        pcapFile.Close()
     }
+    return filtered
 }
 
 //converts a gopacket.Packet into a CaidaPkt
@@ -150,11 +315,91 @@ func convertToCaidaPkt(
 //loads the caida trace file into packets
 func LoadPCAPFile(
         pcapFilename string, timesFilename string, maxNumPkts int) *TraceData{
+    return LoadFilteredPCAPFile(pcapFilename, timesFilename, "", maxNumPkts)
+}
+
+//loads the caida trace file into packets, keeping only the packets that
+//match bpfFilter (see loopOverPCAPFile)
+func LoadFilteredPCAPFile(
+        pcapFilename string, timesFilename string, bpfFilter string,
+        maxNumPkts int) *TraceData{
     trace := newTraceData(maxNumPkts)
-    loopOverPCAPFile(
+    appendPCAPFile(trace, pcapFilename, timesFilename, bpfFilter)
+
+    // the filter may leave fewer packets than maxNumPkts
+    trace.Packets = trace.Packets[:trace.PacketCounter]
+    trace.PacketsInitialized = true
+    printCounters(trace)
+
+    return trace
+}
+
+//loads a dataset that is split over several pcap files as one continuous
+//trace. pattern is either a directory or a glob pattern; the matching pcap
+//files are read in lexical order, each together with the times file of the
+//same name (see timesFileFor). Files whose first packet lies before the end
+//of the previous file are rejected, other packets that go back in time
+//are dropped (see appendPCAPFile).
+func LoadPCAPDataset(
+        pattern string, bpfFilter string, maxNumPkts int) *TraceData {
+    pcapFilenames, err := datasetFiles(pattern)
+    if err != nil {
+        fmt.Printf("Failed to list dataset %s: %v\n", pattern, err)
+        os.Exit(1)
+    } else if len(pcapFilenames) == 0 {
+        fmt.Printf("No pcap files found in dataset %s\n", pattern)
+        os.Exit(1)
+    }
+
+    trace := newTraceData(maxNumPkts)
+    for _, pcapFilename := range pcapFilenames {
+        if trace.PacketCounter >= len(trace.Packets) {
+            break
+        }
+        timesFilename, err := timesFileFor(pcapFilename)
+        if err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+        appendPCAPFile(trace, pcapFilename, timesFilename, bpfFilter)
+    }
+
+    trace.Packets = trace.Packets[:trace.PacketCounter]
+    trace.PacketsInitialized = true
+    printCounters(trace)
+
+    return trace
+}
+
+//reads one pcap/times file pair and appends its packets to trace until the
+//trace is full. The trace stays in time order: if the first packet of the
+//file lies before the last packet of the trace, the file is rejected, and
+//any later packet that lies before the one preceding it is dropped and
+//counted as out of order.
+func appendPCAPFile(trace *TraceData,
+        pcapFilename string, timesFilename string, bpfFilter string) {
+    stats := FileStats{
+        PcapFilename: pcapFilename,
+        TimesFilename: timesFilename,
+    }
+    pktsBefore := trace.PacketCounter
+    errsBefore := trace.ErrCounter
+
+    filtered := loopOverPCAPFile(
         pcapFilename,
         timesFilename,
+        bpfFilter,
         func(packet gopacket.Packet, pktTime time.Duration) bool {
+            if trace.PacketCounter > 0 &&
+                pktTime < trace.Packets[trace.PacketCounter - 1].Duration {
+                if trace.PacketCounter == pktsBefore {
+                    // the file does not continue the previous one
+                    stats.Rejected = true
+                    return false
+                }
+                stats.OutOfOrderCounter++
+                return true
+            }
             trace.Packets[trace.PacketCounter] =
                 convertToCaidaPkt(trace, packet, pktTime)
             trace.PacketCounter++
@@ -167,17 +412,62 @@ func LoadPCAPFile(
             return true   
         })
 
-    trace.PacketsInitialized = true
-    printCounters(trace)
+    if !stats.Rejected {
+        stats.PacketCounter = trace.PacketCounter - pktsBefore
+        stats.ErrCounter = trace.ErrCounter - errsBefore
+        stats.FilteredCounter = filtered
+        trace.FilteredCounter += filtered
+        trace.OutOfOrderCounter += stats.OutOfOrderCounter
+    }
+    trace.Files = append(trace.Files, stats)
+}
 
-    return trace
+//expands a dataset pattern into the sorted list of pcap files it denotes
+func datasetFiles(pattern string) ([]string, error) {
+    if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+        pattern = filepath.Join(pattern, "*")
+    }
+    matches, err := filepath.Glob(pattern)
+    if err != nil {
+        return nil, err
+    }
+    pcapFilenames := make([]string, 0, len(matches))
+    for _, m := range matches {
+        if strings.HasSuffix(trimCompressionSuffix(m), ".pcap") {
+            pcapFilenames = append(pcapFilenames, m)
+        }
+    }
+    sort.Strings(pcapFilenames)
+    return pcapFilenames, nil
+}
+
+//returns the times file that belongs to a pcap file: foo.pcap[.gz|.bz2]
+//pairs with foo.times, foo.times.gz or foo.times.bz2
+func timesFileFor(pcapFilename string) (string, error) {
+    base := strings.TrimSuffix(trimCompressionSuffix(pcapFilename), ".pcap")
+    for _, suffix := range []string{".times", ".times.gz", ".times.bz2"} {
+        if _, err := os.Stat(base + suffix); err == nil {
+            return base + suffix, nil
+        }
+    }
+    return "", fmt.Errorf("no times file found for %s", pcapFilename)
+}
+
+func trimCompressionSuffix(filename string) string {
+    for _, suffix := range []string{".gz", ".bz2"} {
+        if strings.HasSuffix(filename, suffix) {
+            return strings.TrimSuffix(filename, suffix)
+        }
+    }
+    return filename
 }
 
 func LoadTxtTraceFile(txtTraceFilename string, maxNumPkts int) *TraceData{
     trace := newTraceData(maxNumPkts)
-    file, err := os.Open(txtTraceFilename)
+    file, err := OpenTraceFile(txtTraceFilename)
     if err != nil {
         fmt.Println(err)
+        os.Exit(1)
     }
     defer file.Close()
 
@@ -202,6 +492,7 @@ func LoadTxtTraceFile(txtTraceFilename string, maxNumPkts int) *TraceData{
         trace.PacketCounter ++
         // fmt.Printf("%d, %d, %f\n", pkt.Id, pkt.Size, pkt.Duration)
     }
+    trace.Packets = trace.Packets[:trace.PacketCounter]
     trace.PacketsInitialized = true
 
     if err := scanner.Err(); err != nil {
@@ -211,6 +502,35 @@ func LoadTxtTraceFile(txtTraceFilename string, maxNumPkts int) *TraceData{
     return trace
 }
 
+//loads a binary trace file as written by writeParsedTraceToBinary, i.e. a
+//sequence of little-endian CaidaPkt records
+func LoadBinaryTraceFile(binTraceFilename string, maxNumPkts int) *TraceData {
+    trace := newTraceData(maxNumPkts)
+    file, err := OpenTraceFile(binTraceFilename)
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+    defer file.Close()
+
+    for trace.PacketCounter < maxNumPkts {
+        pkt := &CaidaPkt{}
+        err = binary.Read(file, binary.LittleEndian, pkt)
+        if err == io.EOF {
+            break
+        } else if err != nil {
+            fmt.Printf("binary.Read failed: %v\n", err)
+            os.Exit(1)
+        }
+        trace.Packets[trace.PacketCounter] = pkt
+        trace.PacketCounter++
+    }
+    trace.Packets = trace.Packets[:trace.PacketCounter]
+    trace.PacketsInitialized = true
+
+    return trace
+}
+
 //parses the caida packet trace and writes the output to a binary file
 func writeParsedTraceToBinary(
         pcapFilename string, timesFilename string) int {
@@ -224,9 +544,10 @@ func writeParsedTraceToBinary(
 
     trace := newTraceData(0) // no need to store packets here
     //loop over trace
-    loopOverPCAPFile(
+    trace.FilteredCounter = loopOverPCAPFile(
         pcapFilename,
         timesFilename,
+        "",
         func(packet gopacket.Packet, pktTime time.Duration) bool {
             pkt := convertToCaidaPkt(trace, packet, pktTime)
             //write to binary file
@@ -279,7 +600,7 @@ func test() {
     murmur3.ResetSeed()
 
     //open file
-    f, err := os.Open("temp.dat")
+    f, err := OpenTraceFile("temp.dat")
     if err != nil {
         fmt.Println("os.Open failed:", err)
         os.Exit(1)
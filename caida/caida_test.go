@@ -1,23 +1,31 @@
 package caida
 
 import (
+    "bytes"
     "encoding/binary"
     "fmt"
+    "io"
+    "io/ioutil"
     "os"
+    "os/exec"
+    "path/filepath"
     "bufio"
+    "strings"
+    "compress/gzip"
     "testing"
     "time"
-    "unsafe"
 
     "github.com/google/gopacket"
     "github.com/google/gopacket/layers"
     "github.com/google/gopacket/pcap"
+    "github.com/google/gopacket/pcapgo"
 
     "github.com/hosslen/lfd/baseline"
     "github.com/hosslen/lfd/eardet"
     "github.com/hosslen/lfd/murmur3"
     "github.com/hosslen/lfd/rlfd"
     "github.com/hosslen/lfd/clef"
+    "github.com/hosslen/lfd/cuckoo"
 
     "github.com/stretchr/testify/assert"
 )
@@ -70,6 +78,10 @@ func TestWriteParsedTraceToBinary(t *testing.T) {
 }
 
 func TestLoadingPacketFromTxtTraceFile(t *testing.T) {
+    //the synthetic trace is generated, not part of the repository
+    if _, err := os.Stat(txtTraceFilename); err != nil {
+        t.Skipf("no synthetic trace: %v", err)
+    }
     txt_maxNumPkts := 2600000
     traceFromTxt := LoadTxtTraceFile(txtTraceFilename, txt_maxNumPkts)
 
@@ -96,8 +108,12 @@ func TestLoadingPacketFromTxtTraceFile(t *testing.T) {
     txt_t_l := time.Duration(txt_beta/txt_gamma)
 
 
-    rd := rlfd.NewRlfdDtctr(uint32(txt_beta), txt_gamma, txt_t_l)
-    bd := baseline.NewBaselineDtctr(txt_beta, txt_gamma)
+    rd, err := rlfd.NewRlfdDtctr(uint32(txt_beta), txt_gamma, txt_t_l,
+        rlfd.DefaultFanout, rlfd.DefaultDepth)
+    if err != nil {
+        t.Fatal(err)
+    }
+    bd := baseline.NewBaselineDtctr(txt_beta, txt_gamma, cuckoo.NewCuckoo())
 
     var flowID uint32
     var pkt *CaidaPkt
@@ -196,6 +212,286 @@ func TestPacketTimestamp(t *testing.T) {
 
 }
 
+//packets removed by the BPF filter are counted, the others are all kept
+func TestLoadFilteredPCAPFile(t *testing.T) {
+    all := LoadPCAPFile(pcapFilename, timesFilename, maxNumPkts)
+    udp := LoadFilteredPCAPFile(pcapFilename, timesFilename, "udp", maxNumPkts)
+
+    assert.Equal(t, all.PacketCounter, udp.PacketCounter + udp.FilteredCounter)
+    assert.Equal(t, 0, udp.TcpCounter)
+    assert.Equal(t, udp.PacketCounter, len(udp.Packets))
+    // timestamps of removed packets must not shift the remaining ones
+    j := 0
+    for i := 0; i < len(all.Packets) && j < len(udp.Packets); i++ {
+        if all.Packets[i].Id == udp.Packets[j].Id &&
+            all.Packets[i].Size == udp.Packets[j].Size {
+            assert.Equal(t, all.Packets[i].Duration, udp.Packets[j].Duration)
+            j++
+        }
+    }
+    assert.Equal(t, len(udp.Packets), j)
+}
+
+//writes a gzip-compressed copy of src to dst
+func gzipFile(t *testing.T, src, dst string) {
+    in, err := os.Open(src)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer in.Close()
+    out, err := os.Create(dst)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer out.Close()
+    zw := gzip.NewWriter(out)
+    if _, err = io.Copy(zw, in); err != nil {
+        t.Fatal(err)
+    }
+    if err = zw.Close(); err != nil {
+        t.Fatal(err)
+    }
+}
+
+//writes a bzip2-compressed copy of src to dst with the bzip2 tool, the
+//standard library cannot compress bzip2
+func bzip2File(t *testing.T, src, dst string) {
+    bzip2, err := exec.LookPath("bzip2")
+    if err != nil {
+        t.Skipf("bzip2 tool not found, cannot write a bzip2 trace: %v", err)
+    }
+    out, err := exec.Command(bzip2, "-c", src).Output()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err = ioutil.WriteFile(dst, out, 0644); err != nil {
+        t.Fatal(err)
+    }
+}
+
+//compressed trace files are detected by content and read transparently
+func TestLoadCompressedPCAPFile(t *testing.T) {
+    plain := LoadPCAPFile(pcapFilename, timesFilename, maxNumPkts)
+    for _, c := range []struct {
+        name string
+        compress func(t *testing.T, src, dst string)
+        magic []byte
+    }{
+        {"gzip", gzipFile, gzipMagic},
+        {"bzip2", bzip2File, bzip2Magic},
+    } {
+        t.Run(c.name, func(t *testing.T) {
+            dir, err := ioutil.TempDir("", "caida")
+            if err != nil {
+                t.Fatal(err)
+            }
+            defer os.RemoveAll(dir)
+
+            // the names deliberately carry no compression suffix
+            pcapOut := filepath.Join(dir, c.name + "-trace.pcap")
+            timesOut := filepath.Join(dir, c.name + "-trace.times")
+            c.compress(t, pcapFilename, pcapOut)
+            c.compress(t, timesFilename, timesOut)
+            // each case reads files of its own format only
+            for _, f := range []string{pcapOut, timesOut} {
+                data, err := ioutil.ReadFile(f)
+                if err != nil {
+                    t.Fatal(err)
+                }
+                assert.True(t, bytes.HasPrefix(data, c.magic),
+                    "%s is not %s-compressed", f, c.name)
+            }
+
+            loaded := LoadPCAPFile(pcapOut, timesOut, maxNumPkts)
+            assert.Equal(t, plain.PacketCounter, loaded.PacketCounter)
+            assert.Equal(t, plain.ErrCounter, loaded.ErrCounter)
+            for i := range plain.Packets {
+                assert.Equal(t, *plain.Packets[i], *loaded.Packets[i])
+            }
+        })
+    }
+}
+
+//pcapng files give the same packets as the pcap file they are made of
+func TestLoadPCAPNGFile(t *testing.T) {
+    dir, err := ioutil.TempDir("", "caida")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    in, err := os.Open(pcapFilename)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer in.Close()
+    r, err := pcapgo.NewReader(in)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ngFilename := filepath.Join(dir, "trace.pcapng")
+    out, err := os.Create(ngFilename)
+    if err != nil {
+        t.Fatal(err)
+    }
+    w, err := pcapgo.NewNgWriter(out, r.LinkType())
+    if err != nil {
+        t.Fatal(err)
+    }
+    for {
+        data, ci, err := r.ReadPacketData()
+        if err == io.EOF {
+            break
+        } else if err != nil {
+            t.Fatal(err)
+        }
+        if err = w.WritePacket(ci, data); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err = w.Flush(); err != nil {
+        t.Fatal(err)
+    }
+    out.Close()
+
+    plain := LoadPCAPFile(pcapFilename, timesFilename, maxNumPkts)
+    ng := LoadPCAPFile(ngFilename, timesFilename, maxNumPkts)
+    assert.Equal(t, plain.PacketCounter, ng.PacketCounter)
+    assert.Equal(t, plain.ErrCounter, ng.ErrCounter)
+    for i := range plain.Packets {
+        assert.Equal(t, *plain.Packets[i], *ng.Packets[i])
+    }
+}
+
+//libpcap compiles filters for DLT values, LINKTYPE_RAW is not one
+func TestDltOf(t *testing.T) {
+    assert.Equal(t, layers.LinkType(12), dltOf(layers.LinkTypeRaw))
+    assert.Equal(t, layers.LinkTypeEthernet, dltOf(layers.LinkTypeEthernet))
+}
+
+//copies the packets [from, to) of the test trace into a new pcap/times pair
+func writeTracePart(t *testing.T, pcapOut, timesOut string, from, to int) {
+    pcapHandle, err := pcap.OpenOffline(pcapFilename)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer pcapHandle.Close()
+    times, err := ioutil.ReadFile(timesFilename)
+    if err != nil {
+        t.Fatal(err)
+    }
+    lines := strings.Split(string(times), "\n")
+
+    f, err := os.Create(pcapOut)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer f.Close()
+    w := pcapgo.NewWriter(f)
+    if err = w.WriteFileHeader(65536, pcapHandle.LinkType()); err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < to; i++ {
+        data, ci, err := pcapHandle.ReadPacketData()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if i >= from {
+            if err = w.WritePacket(ci, data); err != nil {
+                t.Fatal(err)
+            }
+        }
+    }
+    err = ioutil.WriteFile(
+        timesOut, []byte(strings.Join(lines[from:to], "\n") + "\n"), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+}
+
+//a dataset split over several files is loaded as one continuous trace
+func TestLoadPCAPDataset(t *testing.T) {
+    dir, err := ioutil.TempDir("", "caida")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    writeTracePart(t, filepath.Join(dir, "part-0.pcap"),
+        filepath.Join(dir, "part-0.times"), 0, 4000)
+    writeTracePart(t, filepath.Join(dir, "part-1.pcap"),
+        filepath.Join(dir, "part-1.times"), 4000, maxNumPkts)
+    gzipFile(t, filepath.Join(dir, "part-1.pcap"),
+        filepath.Join(dir, "part-1.pcap.gz"))
+    os.Remove(filepath.Join(dir, "part-1.pcap"))
+    // starts before the end of part-1 and must be rejected
+    writeTracePart(t, filepath.Join(dir, "part-2.pcap"),
+        filepath.Join(dir, "part-2.times"), 100, 200)
+
+    whole := LoadPCAPFile(pcapFilename, timesFilename, maxNumPkts)
+    dataset := LoadPCAPDataset(dir, "", maxNumPkts + 1)
+
+    assert.Equal(t, whole.PacketCounter, dataset.PacketCounter)
+    assert.Equal(t, whole.ErrCounter, dataset.ErrCounter)
+    for i := range whole.Packets {
+        assert.Equal(t, *whole.Packets[i], *dataset.Packets[i])
+    }
+    assert.Equal(t, 3, len(dataset.Files))
+    assert.Equal(t, 4000, dataset.Files[0].PacketCounter)
+    assert.Equal(t, maxNumPkts - 4000, dataset.Files[1].PacketCounter)
+    assert.Equal(t, true, dataset.Files[2].Rejected)
+    assert.Equal(t, 0, dataset.Files[2].PacketCounter)
+
+    // a glob pattern selects a subset of the files
+    glob := LoadPCAPDataset(filepath.Join(dir, "part-0.*"), "", maxNumPkts)
+    assert.Equal(t, 4000, glob.PacketCounter)
+}
+
+//a packet that goes back in time in the middle of a file is dropped, the
+//packets after it are kept
+func TestLoadPCAPDatasetOutOfOrder(t *testing.T) {
+    dir, err := ioutil.TempDir("", "caida")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    writeTracePart(t, filepath.Join(dir, "part-0.pcap"),
+        filepath.Join(dir, "part-0.times"), 0, 4000)
+    timesPart1 := filepath.Join(dir, "part-1.times")
+    writeTracePart(t, filepath.Join(dir, "part-1.pcap"), timesPart1,
+        4000, maxNumPkts)
+    // packet 500 of part-1 gets the time of its first packet
+    times, err := ioutil.ReadFile(timesPart1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    lines := strings.Split(string(times), "\n")
+    lines[500] = lines[0]
+    err = ioutil.WriteFile(timesPart1, []byte(strings.Join(lines, "\n")), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    whole := LoadPCAPFile(pcapFilename, timesFilename, maxNumPkts)
+    dataset := LoadPCAPDataset(dir, "", maxNumPkts)
+
+    assert.Equal(t, whole.PacketCounter - 1, dataset.PacketCounter)
+    assert.Equal(t, 1, dataset.OutOfOrderCounter)
+    assert.Equal(t, 1, dataset.Files[1].OutOfOrderCounter)
+    assert.Equal(t, false, dataset.Files[1].Rejected)
+    for i, pkt := range dataset.Packets {
+        j := i
+        if i >= 4500 {
+            j++
+        }
+        assert.Equal(t, *whole.Packets[j], *pkt)
+        if i > 0 {
+            assert.True(t, pkt.Duration >= dataset.Packets[i - 1].Duration)
+        }
+    }
+}
+
 //measure detection performance of the EARDet detector against the baseline detector
 func TestEARDetPerformanceAgainstBaseline(t *testing.T) {
     //FP and FN
@@ -211,9 +507,12 @@ func TestEARDetPerformanceAgainstBaseline(t *testing.T) {
     blackListBD := make(map[uint32]int)
 
     //initialize detectors
-    ed := eardet.NewConfigedEardetDtctr(
+    ed, err := eardet.NewConfigedEardetDtctr(
         ed_counter_num, alpha, beta_l, gamma_l, p)
-    bd := baseline.NewBaselineDtctr(beta, gamma)
+    if err != nil {
+        t.Fatal(err)
+    }
+    bd := baseline.NewBaselineDtctr(beta, gamma, cuckoo.NewCuckoo())
 
     //initialize packets
     if trace == nil {
@@ -267,9 +566,9 @@ func TestEARDetPerformanceAgainstBaseline(t *testing.T) {
         } 
     }
     fmt.Printf("TestEARDetPerformanceAgainstBaseline:\n")
-    fmt.Printf("eardetDtctr: alpha=%d, gamma_l=%d, beta_l=%d, gamma_h=%d, beta_h=%d, beta_th=%d, p=%fB/ns\n",
-                ed.GetAlpha, ed.GetGamma_l, ed.GetBeta_l,
-                ed.GetGamma_h, ed.GetBeta_h, ed.GetBeta_th, p)
+    fmt.Printf("eardetDtctr: alpha=%d, gamma_l=%f, beta_l=%d, gamma_h=%f, beta_h=%d, beta_th=%d, p=%fB/ns\n",
+                ed.GetAlpha(), ed.GetGamma_l(), ed.GetBeta_l(),
+                ed.GetGamma_h(), ed.GetBeta_h(), ed.GetBeta_th(), p)
     fmt.Printf("baselineDtctr: beta=%f, gamma=%f\n", beta, gamma)
     fmt.Printf("Seed for murmur3: %d\n", murmur3.GetSeed())
     fmt.Printf("Number of flows: %d\n", bd.NumFlows)
@@ -294,8 +593,12 @@ func TestRLFDPerformanceAgainstBaseline(t *testing.T) {
     blackListBD := make(map[uint32]int)
 
     //initialize detectors
-    rd := rlfd.NewRlfdDtctr(uint32(beta), gamma, t_l)
-    bd := baseline.NewBaselineDtctr(beta, gamma)
+    rd, err := rlfd.NewRlfdDtctr(uint32(beta), gamma, t_l,
+        rlfd.DefaultFanout, rlfd.DefaultDepth)
+    if err != nil {
+        t.Fatal(err)
+    }
+    bd := baseline.NewBaselineDtctr(beta, gamma, cuckoo.NewCuckoo())
 
     //initialize packets
     if trace == nil {
@@ -371,15 +674,33 @@ func TestCLEFPerformanceAgainstBaseline(t *testing.T) {
     falsePositiveDamage := uint32(0)
 
     //blacklists
-    blackListRD := make(map[complex128]int)
-    blackListBD := make(map[complex128]int)
+    blackListCD := make(map[uint32]int)
+    blackListBD := make(map[uint32]int)
 
     //initialize detectors
-    eardet := eardet.NewConfigedEardetDtctr(ed_counter_num, alpha, beta_l, gamma_l, p)
-    rlfd1 := rlfd.NewRlfdDtctr(uint32(beta), gamma, t_l)
-    rlfd2 := rlfd.NewRlfdDtctr(uint32(beta), gamma, time.Duration((2*7*gamma_h)/(1.5*gamma))*t_l)
-    cd := clef.NewClefDtctr(eardet, rlfd1, rlfd2, gamma, beta, maxWatchlistSize)
-    bd := baseline.NewBaselineDtctr(beta, gamma)
+    eardet, err := eardet.NewConfigedEardetDtctr(ed_counter_num, alpha, beta_l, gamma_l, p)
+    if err != nil {
+        t.Fatal(err)
+    }
+    rlfd1, err := rlfd.NewRlfdDtctr(uint32(beta), gamma, t_l,
+        rlfd.DefaultFanout, rlfd.DefaultDepth)
+    if err != nil {
+        t.Fatal(err)
+    }
+    rlfd2, err := rlfd.NewRlfdDtctr(uint32(beta), gamma,
+        time.Duration((2*7*gamma_h)/(1.5*gamma))*t_l,
+        rlfd.DefaultFanout, rlfd.DefaultDepth)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cd, err := clef.NewCustomClefDtctr(
+        []clef.Subdetector{eardet, rlfd1, rlfd2},
+        gamma, beta, maxWatchlistSize, t_l, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer cd.Close()
+    bd := baseline.NewBaselineDtctr(beta, gamma, cuckoo.NewCuckoo())
 
     //initialize packets
     if trace == nil {
@@ -387,28 +708,27 @@ func TestCLEFPerformanceAgainstBaseline(t *testing.T) {
     }
 
     var pkt *CaidaPkt
-    var flowID complex128
+    var flowID uint32
     murmur3.ResetSeed()
     cd.SetCurrentTime(trace.Packets[0].Duration)
     var resCD, resBD bool
     for i := 0; i < len(trace.Packets); i++ {
         pkt = trace.Packets[i]
-        flowID = *((*complex128) (unsafe.Pointer(&pkt.Id)))
-        if _, ok := blackListRD[flowID]; !ok {
-            resCD = cd.Detect(&pkt.Id, pkt.Size, pkt.Duration)
+        flowID = murmur3.Murmur3_32_caida(&pkt.Id)
+        if _, ok := blackListCD[flowID]; !ok {
+            resCD = cd.Detect(flowID, pkt.Size, pkt.Duration)
         } else {
             resCD = true
         }
         if _, ok := blackListBD[flowID]; !ok {
-            //TODO: Change this
-            resBD = bd.Detect(0, pkt.Size, pkt.Duration)
+            resBD = bd.Detect(flowID, pkt.Size, pkt.Duration)
         } else {
             resBD = true
         }
 
         //update blacklists
         if resCD {
-            blackListRD[flowID]++
+            blackListCD[flowID]++
         }
         if resBD {
             blackListBD[flowID]++
@@ -423,13 +743,13 @@ func TestCLEFPerformanceAgainstBaseline(t *testing.T) {
     }
 
     //compare blacklists
-    for k, _ := range blackListRD {
+    for k, _ := range blackListCD {
         if _, ok := blackListBD[k]; !ok {
             falsePositives++
         } 
     }
     for k, _ := range blackListBD {
-        if _, ok := blackListRD[k]; !ok {
+        if _, ok := blackListCD[k]; !ok {
             falseNegatives++
         } 
     }
@@ -439,7 +759,7 @@ func TestCLEFPerformanceAgainstBaseline(t *testing.T) {
     fmt.Printf("Seed for murmur3: %d\n", murmur3.GetSeed())
     fmt.Printf("Number of flows: %d\n", bd.NumFlows)
     fmt.Printf("Number of flows detected by baseline: %d\n", len(blackListBD))
-    fmt.Printf("Number of flows detected by clef: %d\n", len(blackListRD))
+    fmt.Printf("Number of flows detected by clef: %d\n", len(blackListCD))
     fmt.Printf("FP (flows): %d FN (flows): %d\n", falsePositives, falseNegatives)
     fmt.Printf("overuseDamage: %dB, falsePositiveDamage: %dB\n", overuseDamage, falsePositiveDamage)
 }
@@ -494,8 +814,11 @@ func TestForHashCollisions(t *testing.T) {
 ///////////////////////////////////////////////////////////////////////////////////////////
 func BenchmarkEARDetWithTraceMemoryLowBinary(b *testing.B) {
     //10Gbps = 1.25B/ns
-    detector := eardet.NewConfigedEardetDtctr(
+    detector, err := eardet.NewConfigedEardetDtctr(
         ed_counter_num, alpha, beta_l, gamma_l, p)
+    if err != nil {
+        b.Fatal(err)
+    }
     var flowID uint32
     pkt := &CaidaPkt{}
     var set bool
@@ -542,7 +865,7 @@ func BenchmarkEARDetWithTraceMemoryLowBinary(b *testing.B) {
 
 func BenchmarkBaselineWithTraceMemoryLowBinary(b *testing.B) {
     //10Gbps = 1.25B/ns
-    detector := baseline.NewBaselineDtctr(beta, gamma)
+    detector := baseline.NewBaselineDtctr(beta, gamma, cuckoo.NewCuckoo())
     var flowID uint32
     pkt := &CaidaPkt{}
     murmur3.ResetSeed()
@@ -585,8 +908,11 @@ func TestEARDetWithTraceMemoryLowBinary(t *testing.T) {
     var totalProcTime time.Duration
     var tic time.Time
     //10Gbps = 1.25B/ns
-    detector := eardet.NewConfigedEardetDtctr(
+    detector, err := eardet.NewConfigedEardetDtctr(
         ed_counter_num, alpha, beta_l, gamma_l, p)
+    if err != nil {
+        t.Fatal(err)
+    }
     var flowID uint32
     pkt := &CaidaPkt{}
     var set bool
@@ -640,7 +966,7 @@ func TestBaselinetWithTraceMemoryLowBinary(t *testing.T) {
     var totalProcTime time.Duration
     var tic time.Time
     //10Gbps = 1.25B/ns
-    detector := baseline.NewBaselineDtctr(beta, gamma)
+    detector := baseline.NewBaselineDtctr(beta, gamma, cuckoo.NewCuckoo())
     var flowID uint32
     pkt := &CaidaPkt{}
     var temp time.Duration
@@ -691,8 +1017,11 @@ func TestEARDetWithTraceMemoryLowDirect(t *testing.T) {
     var totalProcTime time.Duration
     var tic time.Time
     //10Gbps = 1.25B/ns
-    detector := eardet.NewConfigedEardetDtctr(
+    detector, err := eardet.NewConfigedEardetDtctr(
         ed_counter_num, alpha, beta_l, gamma_l, p)
+    if err != nil {
+        t.Fatal(err)
+    }
     var flowID uint32
     var pkt *CaidaPkt
     var set bool
@@ -705,6 +1034,7 @@ func TestEARDetWithTraceMemoryLowDirect(t *testing.T) {
     loopOverPCAPFile(
         pcapFilename,
         timesFilename, 
+        "",
         func(packet gopacket.Packet, pktTime time.Duration) bool {
             pkt = convertToCaidaPkt(&TraceData{}, packet, pktTime)
             if !set {
@@ -732,7 +1062,7 @@ func TestBaselineWithTraceMemoryLowDirect(t *testing.T) {
     var totalProcTime time.Duration
     var tic time.Time
     //10Gbps = 1.25B/ns
-    detector := baseline.NewBaselineDtctr(beta, gamma)
+    detector := baseline.NewBaselineDtctr(beta, gamma, cuckoo.NewCuckoo())
     var flowID uint32
     var pkt *CaidaPkt
     var temp time.Duration
@@ -795,7 +1125,7 @@ func BenchmarkWithTraceLoadedBaseline(b *testing.B) {
         trace = LoadPCAPFile(pcapFilename, timesFilename, maxNumPkts)
     }
     //10Gbps = 1.25B/ns
-    detector := baseline.NewBaselineDtctr(beta, gamma)
+    detector := baseline.NewBaselineDtctr(beta, gamma, cuckoo.NewCuckoo())
     var flowID uint32
     var pkt *CaidaPkt
     murmur3.ResetSeed()
@@ -817,8 +1147,11 @@ func BenchmarkWithTraceLoadedEARDet(b *testing.B) {
         trace = LoadPCAPFile(pcapFilename, timesFilename, maxNumPkts)
     }
     //10Gbps = 1.25B/ns
-    detector := eardet.NewConfigedEardetDtctr(
+    detector, err := eardet.NewConfigedEardetDtctr(
         ed_counter_num, alpha, beta_l, gamma_l, p)
+    if err != nil {
+        b.Fatal(err)
+    }
     var flowID uint32
     var pkt *CaidaPkt
     murmur3.ResetSeed()
@@ -840,7 +1173,11 @@ func BenchmarkWithTraceLoadedRlfd(b *testing.B) {
     if trace == nil {
         trace = LoadPCAPFile(pcapFilename, timesFilename, maxNumPkts)
     }
-    detector := rlfd.NewRlfdDtctr(uint32(beta), gamma, 100)
+    detector, err := rlfd.NewRlfdDtctr(uint32(beta), gamma, 100,
+        rlfd.DefaultFanout, rlfd.DefaultDepth)
+    if err != nil {
+        b.Fatal(err)
+    }
     var flowID uint32
     var pkt *CaidaPkt
     murmur3.ResetSeed()
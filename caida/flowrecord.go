@@ -0,0 +1,640 @@
+// this file turns flow export records (NetFlow v5, NetFlow v9 and IPFIX)
+// into a synthetic packet trace, so that the detectors can be evaluated on
+// links for which only flow telemetry is available
+package caida
+
+import (
+    "bufio"
+    "container/heap"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "math"
+    "math/rand"
+    "os"
+    "strings"
+    "time"
+)
+
+//determines how the packets of a flow record are placed in time
+type SpreadingModel int
+
+const (
+    //packets are evenly spaced between the start and the end of the flow
+    SpreadUniform SpreadingModel = iota
+    //all packets of a record get the start time of the flow; they are not
+    //spaced by their size at line rate, since a flow file does not give
+    //the link capacity
+    SpreadBurst
+    //packet times are drawn uniformly at random between start and end
+    SpreadRandom
+)
+
+//seed of SpreadRandom, fixed so that a flow file always gives the same trace
+const spreadRandomSeed = 1
+
+const (
+    netflowV5 = 5
+    netflowV9 = 9
+    ipfix = 10
+
+    netflowV5HeaderLen = 24
+    netflowV5RecordLen = 48
+    netflowV9HeaderLen = 20
+    ipfixHeaderLen = 16
+    //flow set header: set id and length
+    setHeaderLen = 4
+    //variable-length information element (IPFIX)
+    varLen = 65535
+)
+
+//information elements understood by the v9/IPFIX parser
+const (
+    ieOctetDeltaCount = 1
+    iePacketDeltaCount = 2
+    ieProtocol = 4
+    ieSourcePort = 7
+    ieSourceIPv4 = 8
+    ieDestinationPort = 11
+    ieDestinationIPv4 = 12
+    ieSourceIPv6 = 27
+    ieDestinationIPv6 = 28
+    ieLastSwitched = 21
+    ieFirstSwitched = 22
+    ieOctetTotalCount = 85
+    iePacketTotalCount = 86
+    ieFlowStartSeconds = 150
+    ieFlowEndSeconds = 151
+    ieFlowStartMilliseconds = 152
+    ieFlowEndMilliseconds = 153
+    ieSystemInitTimeMilliseconds = 160
+)
+
+//returns the spreading model with the given name ("uniform", "burst" or
+//"random"); the empty name selects the uniform model
+func ParseSpreadingModel(name string) (SpreadingModel, error) {
+    switch strings.ToLower(name) {
+    case "", "uniform":
+        return SpreadUniform, nil
+    case "burst":
+        return SpreadBurst, nil
+    case "random":
+        return SpreadRandom, nil
+    }
+    return SpreadUniform, fmt.Errorf("unknown spreading model %q", name)
+}
+
+func (m SpreadingModel) String() string {
+    switch m {
+    case SpreadBurst:
+        return "burst"
+    case SpreadRandom:
+        return "random"
+    }
+    return "uniform"
+}
+
+//one flow record, reduced to what is needed to synthesize its packets
+type flowRecord struct {
+    //same layout as CaidaPkt.Id
+    id [16]byte
+    packets uint64
+    bytes uint64
+    start time.Duration
+    end time.Duration
+}
+
+type templateField struct {
+    id uint16
+    length uint16
+}
+
+//v9 and IPFIX templates, by observation domain (source id) and template id
+type templateKey struct {
+    version uint16
+    domain uint32
+    id uint16
+}
+
+type flowFileParser struct {
+    r *bufio.Reader
+    templates map[templateKey][]templateField
+    records []*flowRecord
+    //malformed messages and records, and data sets without a template
+    errCounter int
+    //IPv6 records, skipped since flow IDs only hold IPv4 addresses
+    ipv6Counter int
+}
+
+//reads all flow export messages in flowFilename, expands the flow records
+//into packets according to model and returns them as a trace ordered by
+//time. The file is a plain concatenation of export messages as they are
+//sent by the exporter (optionally gzip or bzip2 compressed); NetFlow v5,
+//NetFlow v9 and IPFIX messages may be mixed.
+func LoadFlowFile(
+        flowFilename string, model SpreadingModel, maxNumPkts int) *TraceData {
+    file, err := OpenTraceFile(flowFilename)
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+    defer file.Close()
+
+    p := &flowFileParser{
+        r: bufio.NewReader(file),
+        templates: make(map[templateKey][]templateField),
+    }
+    if err = p.parse(); err != nil {
+        fmt.Printf("Failed to parse flow file %s: %v\n", flowFilename, err)
+        os.Exit(1)
+    }
+
+    trace := newTraceData(maxNumPkts)
+    trace.ErrCounter = p.errCounter
+    expandFlowRecords(trace, p.records, model)
+    trace.Packets = trace.Packets[:trace.PacketCounter]
+    trace.PacketsInitialized = true
+
+    fmt.Printf("Number of flow records: %d (%s spreading)\n",
+        len(p.records), model)
+    fmt.Printf("Number of IPv6 flow records skipped: %d\n", p.ipv6Counter)
+    printCounters(trace)
+
+    return trace
+}
+
+//parses messages until the end of the file
+func (p *flowFileParser) parse() error {
+    for {
+        hdr, err := p.r.Peek(2)
+        if err == io.EOF {
+            return nil
+        } else if err != nil {
+            return err
+        }
+        switch version := binary.BigEndian.Uint16(hdr); version {
+        case netflowV5:
+            err = p.parseV5()
+        case netflowV9:
+            err = p.parseV9()
+        case ipfix:
+            err = p.parseIPFIX()
+        default:
+            return fmt.Errorf("unsupported export version %d", version)
+        }
+        if err != nil {
+            return err
+        }
+    }
+}
+
+func (p *flowFileParser) read(n int) ([]byte, error) {
+    buf := make([]byte, n)
+    if _, err := io.ReadFull(p.r, buf); err != nil {
+        if err == io.EOF {
+            err = io.ErrUnexpectedEOF
+        }
+        return nil, err
+    }
+    return buf, nil
+}
+
+func (p *flowFileParser) parseV5() error {
+    hdr, err := p.read(netflowV5HeaderLen)
+    if err != nil {
+        return err
+    }
+    count := int(binary.BigEndian.Uint16(hdr[2:4]))
+    sysUptime := binary.BigEndian.Uint32(hdr[4:8])
+    exportTime := time.Duration(binary.BigEndian.Uint32(hdr[8:12]))*time.Second +
+        time.Duration(binary.BigEndian.Uint32(hdr[12:16]))
+
+    body, err := p.read(count*netflowV5RecordLen)
+    if err != nil {
+        return err
+    }
+    for i := 0; i < count; i++ {
+        b := body[i*netflowV5RecordLen : (i + 1)*netflowV5RecordLen]
+        rec := &flowRecord{}
+        copy(rec.id[:4], b[0:4])
+        copy(rec.id[4:8], b[4:8])
+        rec.id[8] = b[38]
+        copy(rec.id[9:13], b[32:36])
+        rec.packets = uint64(binary.BigEndian.Uint32(b[16:20]))
+        rec.bytes = uint64(binary.BigEndian.Uint32(b[20:24]))
+        rec.start = uptimeToTime(
+            exportTime, sysUptime, binary.BigEndian.Uint32(b[24:28]))
+        rec.end = uptimeToTime(
+            exportTime, sysUptime, binary.BigEndian.Uint32(b[28:32]))
+        p.addRecord(rec)
+    }
+    return nil
+}
+
+//NetFlow v9 messages carry no length, but the header counts the template
+//and data records of the message, so the message ends after its last
+//record. If a data set cannot be decoded for lack of a template, its
+//records are unknown and the message ends where the next message header
+//(or the end of the file) starts. That is unambiguous because flow set ids
+//2 to 255 are reserved and never start a flow set.
+func (p *flowFileParser) parseV9() error {
+    hdr, err := p.read(netflowV9HeaderLen)
+    if err != nil {
+        return err
+    }
+    count := int(binary.BigEndian.Uint16(hdr[2:4]))
+    sysUptime := binary.BigEndian.Uint32(hdr[4:8])
+    exportTime := time.Duration(binary.BigEndian.Uint32(hdr[8:12]))*time.Second
+    domain := binary.BigEndian.Uint32(hdr[16:20])
+
+    seen := 0
+    counted := true
+    for !counted || seen < count {
+        next, err := p.r.Peek(2)
+        if err != nil && err != io.EOF {
+            return err
+        }
+        if err == io.EOF || binary.BigEndian.Uint16(next) > 1 &&
+                binary.BigEndian.Uint16(next) < 256 {
+            if counted {
+                // fewer records than the header announced
+                p.errCounter++
+            }
+            return nil
+        }
+        setHdr, err := p.read(setHeaderLen)
+        if err != nil {
+            return err
+        }
+        setID := binary.BigEndian.Uint16(setHdr[0:2])
+        setLen := int(binary.BigEndian.Uint16(setHdr[2:4]))
+        if setLen < setHeaderLen {
+            return fmt.Errorf("invalid v9 flow set length %d", setLen)
+        }
+        body, err := p.read(setLen - setHeaderLen)
+        if err != nil {
+            return err
+        }
+        switch {
+        case setID == 0:
+            seen += p.parseTemplates(netflowV9, domain, body)
+        case setID == 1:
+            // options templates describe no flows, but count as records
+            seen += countOptionsTemplates(body)
+        default:
+            n, ok := p.parseDataSet(netflowV9, domain, setID, body,
+                func(rec *flowRecord, f map[uint16]uint64) {
+                    rec.start = uptimeToTime(exportTime, sysUptime,
+                        uint32(f[ieFirstSwitched]))
+                    rec.end = uptimeToTime(exportTime, sysUptime,
+                        uint32(f[ieLastSwitched]))
+                })
+            seen += n
+            counted = counted && ok
+        }
+    }
+    return nil
+}
+
+//number of v9 options templates in an options template set
+func countOptionsTemplates(set []byte) int {
+    n := 0
+    for len(set) >= 6 && binary.BigEndian.Uint16(set[0:2]) >= 256 {
+        scopeLen := int(binary.BigEndian.Uint16(set[2:4]))
+        optionLen := int(binary.BigEndian.Uint16(set[4:6]))
+        if 6 + scopeLen + optionLen > len(set) {
+            break
+        }
+        set = set[6 + scopeLen + optionLen:]
+        n++
+    }
+    return n
+}
+
+func (p *flowFileParser) parseIPFIX() error {
+    hdr, err := p.read(ipfixHeaderLen)
+    if err != nil {
+        return err
+    }
+    msgLen := int(binary.BigEndian.Uint16(hdr[2:4]))
+    exportTime := time.Duration(binary.BigEndian.Uint32(hdr[4:8]))*time.Second
+    domain := binary.BigEndian.Uint32(hdr[12:16])
+    if msgLen < ipfixHeaderLen {
+        return fmt.Errorf("invalid IPFIX message length %d", msgLen)
+    }
+    body, err := p.read(msgLen - ipfixHeaderLen)
+    if err != nil {
+        return err
+    }
+
+    for len(body) >= setHeaderLen {
+        setID := binary.BigEndian.Uint16(body[0:2])
+        setLen := int(binary.BigEndian.Uint16(body[2:4]))
+        if setLen < setHeaderLen || setLen > len(body) {
+            p.errCounter++
+            return nil
+        }
+        set := body[setHeaderLen:setLen]
+        body = body[setLen:]
+        switch {
+        case setID == 2:
+            p.parseTemplates(ipfix, domain, set)
+        case setID == 3:
+            // options templates describe no flows
+        case setID >= 256:
+            p.parseDataSet(ipfix, domain, setID, set,
+                func(rec *flowRecord, f map[uint16]uint64) {
+                    rec.start, rec.end = ipfixTimes(exportTime, f)
+                })
+        }
+    }
+    return nil
+}
+
+//the v9 and IPFIX template set formats only differ in the enterprise bit;
+//returns the number of templates in the set
+func (p *flowFileParser) parseTemplates(
+        version uint16, domain uint32, set []byte) int {
+    n := 0
+    for len(set) >= 4 {
+        id := binary.BigEndian.Uint16(set[0:2])
+        fieldCount := int(binary.BigEndian.Uint16(set[2:4]))
+        set = set[4:]
+        if id < 256 {
+            // padding at the end of the set
+            return n
+        }
+        fields := make([]templateField, 0, fieldCount)
+        for i := 0; i < fieldCount; i++ {
+            if len(set) < 4 {
+                p.errCounter++
+                return n + 1
+            }
+            f := templateField{
+                id: binary.BigEndian.Uint16(set[0:2]),
+                length: binary.BigEndian.Uint16(set[2:4]),
+            }
+            set = set[4:]
+            if version == ipfix && f.id & 0x8000 != 0 {
+                // enterprise-specific element, never one of ours
+                if len(set) < 4 {
+                    p.errCounter++
+                    return n + 1
+                }
+                set = set[4:]
+                f.id = 0
+            }
+            fields = append(fields, f)
+        }
+        p.templates[templateKey{version, domain, id}] = fields
+        n++
+    }
+    return n
+}
+
+//decodes the records of a data set; setTimes fills in the record's start
+//and end time from the decoded fields. Returns the number of records in the
+//set, ok is false if the set has no known template and so no known number
+//of records.
+func (p *flowFileParser) parseDataSet(
+        version uint16, domain uint32, id uint16, set []byte,
+        setTimes func(rec *flowRecord, f map[uint16]uint64)) (n int, ok bool) {
+    fields, ok := p.templates[templateKey{version, domain, id}]
+    if !ok {
+        p.errCounter++
+        return 0, false
+    }
+    minLen := 0
+    for _, f := range fields {
+        if f.length == varLen {
+            minLen++
+        } else {
+            minLen += int(f.length)
+        }
+    }
+    if minLen == 0 {
+        p.errCounter++
+        return 0, false
+    }
+
+    values := make(map[uint16]uint64, len(fields))
+    for len(set) >= minLen {
+        rec := &flowRecord{}
+        ipv6 := false
+        for k := range values {
+            delete(values, k)
+        }
+        for _, f := range fields {
+            length := int(f.length)
+            if f.length == varLen {
+                if len(set) == 0 {
+                    p.errCounter++
+                    return n + 1, true
+                }
+                length = int(set[0])
+                set = set[1:]
+                if length == 255 && len(set) >= 2 {
+                    length = int(binary.BigEndian.Uint16(set[0:2]))
+                    set = set[2:]
+                }
+            }
+            if length > len(set) {
+                p.errCounter++
+                return n + 1, true
+            }
+            b := set[:length]
+            set = set[length:]
+            switch f.id {
+            case ieSourceIPv4:
+                if length == 4 {
+                    copy(rec.id[:4], b)
+                }
+            case ieDestinationIPv4:
+                if length == 4 {
+                    copy(rec.id[4:8], b)
+                }
+            case ieSourceIPv6, ieDestinationIPv6:
+                ipv6 = true
+            case 0:
+            default:
+                values[f.id] = beUint(b)
+            }
+        }
+        rec.id[8] = byte(values[ieProtocol])
+        binary.BigEndian.PutUint16(rec.id[9:11], uint16(values[ieSourcePort]))
+        binary.BigEndian.PutUint16(
+            rec.id[11:13], uint16(values[ieDestinationPort]))
+        rec.packets = values[iePacketDeltaCount]
+        if rec.packets == 0 {
+            rec.packets = values[iePacketTotalCount]
+        }
+        rec.bytes = values[ieOctetDeltaCount]
+        if rec.bytes == 0 {
+            rec.bytes = values[ieOctetTotalCount]
+        }
+        n++
+        if ipv6 {
+            // all IPv6 flows would share the flow ID of address 0
+            p.ipv6Counter++
+            continue
+        }
+        setTimes(rec, values)
+        p.addRecord(rec)
+    }
+    return n, true
+}
+
+func (p *flowFileParser) addRecord(rec *flowRecord) {
+    if rec.packets == 0 || rec.bytes < rec.packets {
+        p.errCounter++
+        return
+    }
+    if rec.end < rec.start {
+        rec.end = rec.start
+    }
+    p.records = append(p.records, rec)
+}
+
+//converts a sysUptime-relative timestamp (in ms) into time since the epoch
+func uptimeToTime(
+        exportTime time.Duration, sysUptime uint32, t uint32) time.Duration {
+    // int32 keeps records that were switched just before an uptime wrap
+    return exportTime - time.Duration(int32(sysUptime - t))*time.Millisecond
+}
+
+func ipfixTimes(
+        exportTime time.Duration,
+        f map[uint16]uint64) (time.Duration, time.Duration) {
+    if start, ok := f[ieFlowStartMilliseconds]; ok {
+        return time.Duration(start)*time.Millisecond,
+            time.Duration(f[ieFlowEndMilliseconds])*time.Millisecond
+    }
+    if start, ok := f[ieFlowStartSeconds]; ok {
+        return time.Duration(start)*time.Second,
+            time.Duration(f[ieFlowEndSeconds])*time.Second
+    }
+    if sysInit, ok := f[ieSystemInitTimeMilliseconds]; ok {
+        base := time.Duration(sysInit)*time.Millisecond
+        return base + time.Duration(f[ieFirstSwitched])*time.Millisecond,
+            base + time.Duration(f[ieLastSwitched])*time.Millisecond
+    }
+    return exportTime, exportTime
+}
+
+//big-endian unsigned integer of up to 8 bytes (reduced-size encoding)
+func beUint(b []byte) uint64 {
+    var v uint64
+    for _, x := range b {
+        v = v<<8 | uint64(x)
+    }
+    return v
+}
+
+//generates the packets of one flow record in time order
+type flowExpander struct {
+    rec *flowRecord
+    //position of the record in the input, to break ties deterministically
+    order int
+    //index of the next packet
+    i uint64
+    //next packet time
+    next time.Duration
+}
+
+//the time of packet fe.i; the random model draws it from r given the time
+//of the packet before, which is in fe.next
+func (fe *flowExpander) packetTime(
+        model SpreadingModel, r *rand.Rand) time.Duration {
+    rec := fe.rec
+    switch model {
+    case SpreadBurst:
+        return rec.start
+    case SpreadRandom:
+        return fe.randomTime(r)
+    }
+    if rec.packets == 1 {
+        return rec.start
+    }
+    return rec.start + time.Duration(
+        float64(rec.end - rec.start)*float64(fe.i)/float64(rec.packets - 1))
+}
+
+//the packet times of the random model are the sorted uniform times of the
+//record's packets. They are drawn one by one, so that no record needs
+//memory for its packet count: the earliest of the k times left, all
+//uniform between the previous time and the end, is at 1 - U^(1/k) of
+//that interval.
+func (fe *flowExpander) randomTime(r *rand.Rand) time.Duration {
+    prev := fe.next
+    k := float64(fe.rec.packets - fe.i)
+    span := float64(fe.rec.end - prev)
+    t := prev + time.Duration(span*(1 - math.Pow(r.Float64(), 1/k)))
+    if t > fe.rec.end {
+        t = fe.rec.end
+    }
+    return t
+}
+
+//the bytes of a record are spread as evenly as possible over its packets
+func (fe *flowExpander) packetSize() uint32 {
+    size := fe.rec.bytes / fe.rec.packets
+    if fe.i < fe.rec.bytes % fe.rec.packets {
+        size++
+    }
+    return uint32(size)
+}
+
+type expanderHeap []*flowExpander
+
+func (h expanderHeap) Len() int { return len(h) }
+func (h expanderHeap) Less(i, j int) bool {
+    if h[i].next != h[j].next {
+        return h[i].next < h[j].next
+    }
+    return h[i].order < h[j].order
+}
+func (h expanderHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *expanderHeap) Push(x interface{}) {
+    *h = append(*h, x.(*flowExpander))
+}
+func (h *expanderHeap) Pop() interface{} {
+    old := *h
+    x := old[len(old) - 1]
+    *h = old[:len(old) - 1]
+    return x
+}
+
+//merges the packets of all records into trace in time order until the
+//trace is full
+func expandFlowRecords(
+        trace *TraceData, records []*flowRecord, model SpreadingModel) {
+    r := rand.New(rand.NewSource(spreadRandomSeed))
+    h := make(expanderHeap, len(records))
+    for i, rec := range records {
+        h[i] = &flowExpander{rec: rec, order: i, next: rec.start}
+        h[i].next = h[i].packetTime(model, r)
+    }
+    heap.Init(&h)
+
+    for h.Len() > 0 && trace.PacketCounter < len(trace.Packets) {
+        fe := h[0]
+        pkt := &CaidaPkt{Duration: fe.next, Id: fe.rec.id,
+            Size: fe.packetSize()}
+        trace.Packets[trace.PacketCounter] = pkt
+        trace.PacketCounter++
+        switch pkt.Id[8] {
+        case 6:
+            trace.TcpCounter++
+        case 17:
+            trace.UdpCounter++
+        }
+
+        fe.i++
+        if fe.i == fe.rec.packets {
+            heap.Pop(&h)
+            continue
+        }
+        fe.next = fe.packetTime(model, r)
+        heap.Fix(&h, 0)
+    }
+}
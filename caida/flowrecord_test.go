@@ -0,0 +1,370 @@
+package caida
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "io/ioutil"
+    "os"
+    "testing"
+    "time"
+)
+
+//export time of all test messages, in seconds since the epoch
+const testExportSecs = 1500000000
+
+//the flows described by the test messages
+var testFlows = []struct{
+    src, dst [4]byte
+    proto byte
+    sport, dport uint16
+    packets, bytes uint32
+    //relative to the export time, in ms
+    start, end int
+}{
+    {[4]byte{10, 0, 0, 1}, [4]byte{10, 0, 0, 2}, 6, 1234, 80, 10, 15000, -900, -100},
+    {[4]byte{10, 0, 0, 3}, [4]byte{10, 0, 0, 4}, 17, 53, 5353, 3, 301, -500, -500},
+}
+
+func put16(b *bytes.Buffer, v uint16) { binary.Write(b, binary.BigEndian, v) }
+func put32(b *bytes.Buffer, v uint32) { binary.Write(b, binary.BigEndian, v) }
+
+func netflowV5Message() []byte {
+    sysUptime := uint32(3600000)
+    b := &bytes.Buffer{}
+    put16(b, 5)
+    put16(b, uint16(len(testFlows)))
+    put32(b, sysUptime)
+    put32(b, testExportSecs)
+    put32(b, 0)
+    put32(b, 0)
+    b.Write(make([]byte, 4))
+    for _, f := range testFlows {
+        b.Write(f.src[:])
+        b.Write(f.dst[:])
+        b.Write(make([]byte, 8))
+        put32(b, f.packets)
+        put32(b, f.bytes)
+        put32(b, uint32(int(sysUptime) + f.start))
+        put32(b, uint32(int(sysUptime) + f.end))
+        put16(b, f.sport)
+        put16(b, f.dport)
+        b.WriteByte(0)
+        b.WriteByte(0)
+        b.WriteByte(f.proto)
+        b.Write(make([]byte, 9))
+    }
+    return b.Bytes()
+}
+
+//the template shared by the v9 and the IPFIX message
+var testTemplate = [][2]uint16{
+    {ieSourceIPv4, 4}, {ieDestinationIPv4, 4}, {ieProtocol, 1},
+    {ieSourcePort, 2}, {ieDestinationPort, 2}, {iePacketDeltaCount, 4},
+    {ieOctetDeltaCount, 4}, {ieFirstSwitched, 4}, {ieLastSwitched, 4},
+}
+
+func writeTemplateSet(b *bytes.Buffer, setID uint16, fields [][2]uint16) {
+    put16(b, setID)
+    put16(b, uint16(4 + 4 + 4*len(fields)))
+    put16(b, 256)
+    put16(b, uint16(len(fields)))
+    for _, f := range fields {
+        put16(b, f[0])
+        put16(b, f[1])
+    }
+}
+
+func writeDataSet(b *bytes.Buffer, sysUptime uint32, millis bool) {
+    data := &bytes.Buffer{}
+    for _, f := range testFlows {
+        data.Write(f.src[:])
+        data.Write(f.dst[:])
+        data.WriteByte(f.proto)
+        put16(data, f.sport)
+        put16(data, f.dport)
+        put32(data, f.packets)
+        put32(data, f.bytes)
+        if millis {
+            binary.Write(data, binary.BigEndian,
+                uint64(testExportSecs*1000 + f.start))
+            binary.Write(data, binary.BigEndian,
+                uint64(testExportSecs*1000 + f.end))
+        } else {
+            put32(data, uint32(int(sysUptime) + f.start))
+            put32(data, uint32(int(sysUptime) + f.end))
+        }
+    }
+    // pad to a multiple of 4 bytes
+    for data.Len() % 4 != 0 {
+        data.WriteByte(0)
+    }
+    put16(b, 256)
+    put16(b, uint16(4 + data.Len()))
+    b.Write(data.Bytes())
+}
+
+func netflowV9Message() []byte {
+    sysUptime := uint32(7200000)
+    b := &bytes.Buffer{}
+    put16(b, 9)
+    put16(b, uint16(1 + len(testFlows)))
+    put32(b, sysUptime)
+    put32(b, testExportSecs)
+    put32(b, 0)
+    put32(b, 42)
+    writeTemplateSet(b, 0, testTemplate)
+    writeDataSet(b, sysUptime, false)
+    return b.Bytes()
+}
+
+func ipfixMessage() []byte {
+    fields := make([][2]uint16, len(testTemplate))
+    copy(fields, testTemplate)
+    fields[7] = [2]uint16{ieFlowStartMilliseconds, 8}
+    fields[8] = [2]uint16{ieFlowEndMilliseconds, 8}
+
+    sets := &bytes.Buffer{}
+    writeTemplateSet(sets, 2, fields)
+    writeDataSet(sets, 0, true)
+
+    b := &bytes.Buffer{}
+    put16(b, 10)
+    put16(b, uint16(ipfixHeaderLen + sets.Len()))
+    put32(b, testExportSecs)
+    put32(b, 0)
+    put32(b, 42)
+    b.Write(sets.Bytes())
+    return b.Bytes()
+}
+
+//an IPFIX message with one IPv6 flow record
+func ipfixIPv6Message() []byte {
+    fields := [][2]uint16{
+        {ieSourceIPv6, 16}, {ieDestinationIPv6, 16}, {ieProtocol, 1},
+        {iePacketDeltaCount, 4}, {ieOctetDeltaCount, 4},
+    }
+    data := &bytes.Buffer{}
+    src := make([]byte, 16)
+    src[0], src[1], src[15] = 0x20, 0x01, 1
+    data.Write(src)
+    src[15] = 2
+    data.Write(src)
+    data.WriteByte(6)
+    put32(data, 2)
+    put32(data, 3000)
+    for data.Len() % 4 != 0 {
+        data.WriteByte(0)
+    }
+
+    sets := &bytes.Buffer{}
+    writeTemplateSet(sets, 2, fields)
+    put16(sets, 256)
+    put16(sets, uint16(4 + data.Len()))
+    sets.Write(data.Bytes())
+
+    b := &bytes.Buffer{}
+    put16(b, 10)
+    put16(b, uint16(ipfixHeaderLen + sets.Len()))
+    put32(b, testExportSecs)
+    put32(b, 0)
+    put32(b, 43)
+    b.Write(sets.Bytes())
+    return b.Bytes()
+}
+
+func writeFlowFile(t *testing.T, messages ...[]byte) string {
+    f, err := ioutil.TempFile("", "flows")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer f.Close()
+    for _, m := range messages {
+        f.Write(m)
+    }
+    return f.Name()
+}
+
+//checks that every test flow was expanded into its packets
+func checkExpandedFlows(
+        t *testing.T, trace *TraceData, copies int, model SpreadingModel) {
+    exportTime := time.Duration(testExportSecs)*time.Second
+    for _, f := range testFlows {
+        var id [16]byte
+        copy(id[:4], f.src[:])
+        copy(id[4:8], f.dst[:])
+        id[8] = f.proto
+        binary.BigEndian.PutUint16(id[9:11], f.sport)
+        binary.BigEndian.PutUint16(id[11:13], f.dport)
+        start := exportTime + time.Duration(f.start)*time.Millisecond
+        end := exportTime + time.Duration(f.end)*time.Millisecond
+
+        var pkts, size uint32
+        for _, pkt := range trace.Packets {
+            if pkt.Id != id {
+                continue
+            }
+            pkts++
+            size += pkt.Size
+            if pkt.Duration < start || pkt.Duration > end {
+                t.Errorf("%s: packet at %d outside of flow [%d, %d]",
+                    model, pkt.Duration, start, end)
+            }
+            if model == SpreadBurst && pkt.Duration != start {
+                t.Errorf("burst: packet at %d, flow starts at %d",
+                    pkt.Duration, start)
+            }
+        }
+        if pkts != uint32(copies)*f.packets || size != uint32(copies)*f.bytes {
+            t.Errorf("%s: flow expanded into %d packets (%dB), want %d (%dB)",
+                model, pkts, size, uint32(copies)*f.packets,
+                uint32(copies)*f.bytes)
+        }
+    }
+    for i := 1; i < len(trace.Packets); i++ {
+        if trace.Packets[i].Duration < trace.Packets[i - 1].Duration {
+            t.Errorf("%s: packets are not ordered by time", model)
+            break
+        }
+    }
+}
+
+//v5, v9 and IPFIX messages describing the same flows give the same packets
+func TestLoadFlowFile(t *testing.T) {
+    name := writeFlowFile(t,
+        netflowV5Message(), netflowV9Message(), ipfixMessage())
+    defer os.Remove(name)
+
+    for _, model := range []SpreadingModel{
+            SpreadUniform, SpreadBurst, SpreadRandom} {
+        trace := LoadFlowFile(name, model, 1000)
+        if trace.ErrCounter != 0 {
+            t.Errorf("%s: %d errors", model, trace.ErrCounter)
+        }
+        checkExpandedFlows(t, trace, 3, model)
+    }
+}
+
+//uniform spreading spaces the packets evenly and splits the bytes evenly
+func TestUniformSpreading(t *testing.T) {
+    name := writeFlowFile(t, netflowV5Message())
+    defer os.Remove(name)
+
+    trace := LoadFlowFile(name, SpreadUniform, 1000)
+    var gaps []time.Duration
+    var last *CaidaPkt
+    for _, pkt := range trace.Packets {
+        if pkt.Id[8] != 6 {
+            continue
+        }
+        if pkt.Size != 1500 {
+            t.Errorf("packet size is %d, should be 1500", pkt.Size)
+        }
+        if last != nil {
+            gaps = append(gaps, pkt.Duration - last.Duration)
+        }
+        last = pkt
+    }
+    want := 800*time.Millisecond/9
+    for _, gap := range gaps {
+        // packet times are truncated to the nanosecond
+        if gap < want - 1 || gap > want + 1 {
+            t.Errorf("gap between packets is %d, should be %d", gap, want)
+        }
+    }
+}
+
+//the trace stops at maxNumPkts
+func TestLoadFlowFileMaxNumPkts(t *testing.T) {
+    name := writeFlowFile(t, netflowV5Message())
+    defer os.Remove(name)
+
+    trace := LoadFlowFile(name, SpreadUniform, 5)
+    if trace.PacketCounter != 5 || len(trace.Packets) != 5 {
+        t.Errorf("trace has %d packets, should have 5", len(trace.Packets))
+    }
+}
+
+//the v9 parser ends a message after the records counted in its header
+func TestNetflowV9Count(t *testing.T) {
+    name := writeFlowFile(t, netflowV9Message(), netflowV5Message())
+    defer os.Remove(name)
+    trace := LoadFlowFile(name, SpreadUniform, 1000)
+    if trace.ErrCounter != 0 {
+        t.Errorf("%d errors", trace.ErrCounter)
+    }
+    checkExpandedFlows(t, trace, 2, SpreadUniform)
+
+    //a header that announces more records than the message has
+    short := netflowV9Message()
+    binary.BigEndian.PutUint16(short[2:4], uint16(2 + len(testFlows)))
+    name = writeFlowFile(t, short, netflowV5Message())
+    defer os.Remove(name)
+    trace = LoadFlowFile(name, SpreadUniform, 1000)
+    if trace.ErrCounter != 1 {
+        t.Errorf("%d errors for a short message, want 1", trace.ErrCounter)
+    }
+    checkExpandedFlows(t, trace, 2, SpreadUniform)
+}
+
+//IPv6 records are skipped and counted instead of all sharing the flow ID
+//of address 0
+func TestIPv6FlowRecords(t *testing.T) {
+    msgs := append(ipfixIPv6Message(), ipfixMessage()...)
+    p := &flowFileParser{
+        r: bufio.NewReader(bytes.NewReader(msgs)),
+        templates: make(map[templateKey][]templateField),
+    }
+    if err := p.parse(); err != nil {
+        t.Fatal(err)
+    }
+    if p.ipv6Counter != 1 || p.errCounter != 0 {
+        t.Errorf("%d IPv6 records and %d errors, want 1 and 0",
+            p.ipv6Counter, p.errCounter)
+    }
+    if len(p.records) != len(testFlows) {
+        t.Errorf("%d records, want the %d IPv4 ones", len(p.records),
+            len(testFlows))
+    }
+
+    name := writeFlowFile(t, msgs)
+    defer os.Remove(name)
+    checkExpandedFlows(t, LoadFlowFile(name, SpreadUniform, 1000), 1,
+        SpreadUniform)
+}
+
+//random spreading draws the packet times one by one, so a record with a
+//huge packet count needs no memory for it, and the times are sorted and
+//uniform over the flow
+func TestRandomSpreadingHugeRecord(t *testing.T) {
+    huge := &flowRecord{packets: 1<<62, bytes: 1<<62,
+        start: time.Second, end: 2*time.Second}
+    trace := newTraceData(100000)
+    expandFlowRecords(trace, []*flowRecord{huge}, SpreadRandom)
+    if trace.PacketCounter != len(trace.Packets) {
+        t.Fatalf("%d packets, want %d", trace.PacketCounter, len(trace.Packets))
+    }
+
+    rec := &flowRecord{packets: 100000, bytes: 100000,
+        start: time.Second, end: 2*time.Second}
+    trace = newTraceData(100000)
+    expandFlowRecords(trace, []*flowRecord{rec}, SpreadRandom)
+    if trace.PacketCounter != 100000 {
+        t.Fatalf("%d packets, want 100000", trace.PacketCounter)
+    }
+    var sum float64
+    for i, pkt := range trace.Packets {
+        if pkt.Duration < rec.start || pkt.Duration > rec.end {
+            t.Fatalf("packet at %d outside of flow", pkt.Duration)
+        }
+        if i > 0 && pkt.Duration < trace.Packets[i - 1].Duration {
+            t.Fatalf("packets are not ordered by time")
+        }
+        sum += float64(pkt.Duration - rec.start)
+    }
+    //the mean of 100000 uniform times is within 0.5% of the middle
+    mean := sum/100000/float64(rec.end - rec.start)
+    if mean < 0.495 || mean > 0.505 {
+        t.Errorf("mean packet time at %f of the flow, want 0.5", mean)
+    }
+}
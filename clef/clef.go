@@ -1,6 +1,8 @@
 package clef
 
 import (
+    "reflect"
+    "sync"
     "time"
 
     "fmt"
@@ -18,69 +20,122 @@ type leakyBucket struct {
     //moment in time when last packet for this flow was received
     lastTimestamp time.Duration
     //how many bytes the bucket contains right now
-    count uint32
+    count float64
+    //the bucket overflowed, so the flow was blocked
+    blocked bool
 }
 
-type pktTriple struct {
-    flowID uint32
-    size uint32
-    t time.Duration
+//a packet handed to CLEF and its subdetectors
+type Packet struct {
+    FlowID uint32
+    Size uint32
+    T time.Duration
+}
+
+//a detector CLEF runs on every packet, such as EARDet or RLFD
+type Subdetector interface {
+    Detect(flowID uint32, size uint32, t time.Duration) bool
+    SetCurrentTime(t time.Duration)
 }
 
 type ClefDtctr struct {
 
     //flow lists
-    watchlist map[uint32](*leakyBucket)
-    maxWatchlistSize uint32
+    watchlist *watchlist
     watchlistTimeout time.Duration
     blacklist *cuckoo.CuckooTable
 
-    EdBlocked uint32
-    Rd1Blocked uint32
-    Rd2Blocked uint32
+    //flows that left the watchlist without having overflowed their bucket
+    WatchlistReleased uint32
+    //flows blocked by their bucket
+    WatchlistBlocked uint32
+    //flagged flows blocked right away because the watchlist was full
+    WatchlistFull uint32
+    //flows released early to make room for a flagged flow
+    WatchlistEvicted uint32
 
     //flow specification
     beta float64
     gamma float64
 
     //detectors
-    eardet *eardet.EardetDtctr
-    rlfd1 *rlfd.RlfdDtctr
-    rlfd2 *rlfd.RlfdDtctr
-
-    //channels
-    packetsForEardet chan pktTriple
-    packetsForRlfd1 chan pktTriple
-    packetsForRlfd2 chan pktTriple
-    resultsEardet chan bool
-    resultsRlfd1 chan bool
-    resultsRlfd2 chan bool
+    subdetectors []Subdetector
+    //number of packets of unwatched flows flagged by every subdetector
+    detections []uint64
+    //how many subdetectors must flag a flow
+    quorum int
+    //the subdetectors that flagged the current packet
+    flagged []bool
+    //with a quorum above 1, the recent votes of every unwatched flow, kept
+    //for voteWindow
+    votes map[uint32]*flowVotes
+    voteWindow time.Duration
+    lastVotePurge time.Duration
+
+    //how the subdetectors are run
+    mode ExecutionMode
+    //the worker goroutines that are still running
+    workers sync.WaitGroup
+    closeOnce sync.Once
+    closed bool
+
+    //channels, one per subdetector
+    packets []chan Packet
+    results []chan bool
+
+    //channels of the batched mode, one per subdetector, and the results
+    //each subdetector writes for the current batch
+    batches []chan batchJob
+    batchDone chan bool
+    batchResults [][]bool
+    //batch of a single packet passed to Detect
+    single [1]Packet
 }
 
+//CLEF as in the paper: EARDet and the two RLFDs of Twin-RLFD, each
+//running on its own
 func NewClefDtctr(eardet *eardet.EardetDtctr,
-                  rlfd1, rlfd2 *rlfd.RlfdDtctr,
+                  twin *rlfd.TwinRlfdDtctr,
                   gamma, beta float64,
                   maxWatchlistSize uint32,
-                  blacklist *cuckoo.CuckooTable) *ClefDtctr {
+                  blacklist *cuckoo.CuckooTable) (*ClefDtctr, error) {
+    if eardet == nil || twin == nil {
+        return nil, fmt.Errorf("CLEF needs both EARDet and Twin-RLFD")
+    }
+    rlfd1 := twin.GetRlfd1()
+    return NewCustomClefDtctr(
+        []Subdetector{eardet, rlfd1, twin.GetRlfd2()},
+        gamma, beta, maxWatchlistSize,
+        rlfd1.GetT_l(), // TODO: think how to best set this value
+        blacklist)
+}
+
+//CLEF over any subdetectors, flows flagged by one of them are watched for
+//watchlistTimeout
+func NewCustomClefDtctr(subdetectors []Subdetector,
+                        gamma, beta float64,
+                        maxWatchlistSize uint32,
+                        watchlistTimeout time.Duration,
+                        blacklist *cuckoo.CuckooTable) (*ClefDtctr, error) {
+    if len(subdetectors) == 0 {
+        return nil, fmt.Errorf("CLEF needs at least one subdetector")
+    }
+    for i, sd := range subdetectors {
+        //a nil pointer in the interface is not nil itself
+        if v := reflect.ValueOf(sd); sd == nil || v.Kind() == reflect.Ptr && v.IsNil() {
+            return nil, fmt.Errorf("CLEF subdetector %d is nil", i)
+        }
+    }
     cd := &ClefDtctr{}
 
     //set detectors
-    cd.eardet = eardet
-    cd.rlfd1 = rlfd1
-    cd.rlfd2 = rlfd2
+    cd.subdetectors = append([]Subdetector(nil), subdetectors...)
+    cd.detections = make([]uint64, len(subdetectors))
+    cd.flagged = make([]bool, len(subdetectors))
+    cd.quorum = 1
 
-    //create channels
-    cd.packetsForEardet = make(chan pktTriple, 3)
-    cd.packetsForRlfd1 = make(chan pktTriple, 3)
-    cd.packetsForRlfd2 = make(chan pktTriple, 3)
-
-    cd.resultsEardet = make(chan bool, 3)
-    cd.resultsRlfd1 = make(chan bool, 3)
-    cd.resultsRlfd2 = make(chan bool, 3)
-
-    cd.watchlist = make(map[uint32](*leakyBucket))
-    cd.maxWatchlistSize = maxWatchlistSize
-    cd.watchlistTimeout = rlfd1.GetT_l() // TODO: think how to best set this value
+    cd.watchlist = newWatchlist(maxWatchlistSize, gamma)
+    cd.watchlistTimeout = watchlistTimeout
 
     cd.blacklist = blacklist
 
@@ -88,99 +143,238 @@ func NewClefDtctr(eardet *eardet.EardetDtctr,
     cd.beta = beta
 
     //start worker threads
-    go eardetWorker(cd.eardet, cd.packetsForEardet, cd.resultsEardet)
-    go rlfdWorker(cd.rlfd1, cd.packetsForRlfd1, cd.resultsRlfd1)
-    go rlfdWorker(cd.rlfd2, cd.packetsForRlfd2, cd.resultsRlfd2)
+    cd.startWorkers()
 
-    return cd
+    return cd, nil
 }
 
+//stops the worker goroutines and waits until they are gone. Close may be
+//called more than once, the detector must not be used afterwards.
+func (cd *ClefDtctr) Close() error {
+    cd.closeOnce.Do(func() {
+        cd.closed = true
+        cd.stopWorkers()
+    })
+    return nil
+}
+
+// Deprecated: use Close
 func CleanUpClefDtctr(dtctr *ClefDtctr) {
-    //close channels
-    close(dtctr.packetsForEardet)
-    close(dtctr.packetsForRlfd1)
-    close(dtctr.packetsForRlfd2)
-    close(dtctr.resultsEardet)
-    close(dtctr.resultsRlfd1)
-    close(dtctr.resultsRlfd2)
+    dtctr.Close()
 }
 
 func (cd *ClefDtctr) SetCurrentTime(now time.Duration) {
-    cd.eardet.SetCurrentTime(now)
-    cd.rlfd1.SetCurrentTime(now)
-    cd.rlfd2.SetCurrentTime(now)
+    for _, sd := range cd.subdetectors {
+        sd.SetCurrentTime(now)
+    }
+}
+
+//the subdetectors that flagged a flow and when they last did
+type flowVotes struct {
+    flagged []bool
+    last []time.Duration
+    newest time.Duration
+}
+
+//subdetectors that report their round, such as RLFD
+type roundDetector interface {
+    GetRoundDuration() time.Duration
 }
 
-func (cd *ClefDtctr) cleanupWatchlist(t time.Duration) {
-    for flowID, _ := range cd.watchlist {
-        if (t - cd.watchlist[flowID].firstTimestamp > cd.watchlistTimeout) {
-            delete(cd.watchlist, flowID)
+//a flow is watched once k of the subdetectors flag it, 1 (any subdetector)
+//by default. The subdetectors need not flag the same packet: a vote counts
+//for one round of the slowest subdetector, or for the watchlist timeout if
+//that is longer, since RLFD only flags at the end of its round. Set the
+//quorum after configuring the subdetectors.
+func (cd *ClefDtctr) SetQuorum(k int) error {
+    if k < 1 || k > len(cd.subdetectors) {
+        return fmt.Errorf("CLEF quorum must be in [1, %d], not %d",
+            len(cd.subdetectors), k)
+    }
+    cd.quorum = k
+    cd.votes = make(map[uint32]*flowVotes)
+    cd.voteWindow = cd.watchlistTimeout
+    for _, sd := range cd.subdetectors {
+        if rd, ok := sd.(roundDetector); ok && rd.GetRoundDuration() > cd.voteWindow {
+            cd.voteWindow = rd.GetRoundDuration()
         }
     }
+    return nil
+}
 
+//how long a vote of a subdetector counts towards the quorum
+func (cd *ClefDtctr) GetVoteWindow() time.Duration {
+    return cd.voteWindow
 }
 
+func (cd *ClefDtctr) GetQuorum() int {
+    return cd.quorum
+}
 
-func (cd *ClefDtctr) Detect(flowID uint32, size uint32, t time.Duration) bool {
+func (cd *ClefDtctr) GetSubdetectors() []Subdetector {
+    return append([]Subdetector(nil), cd.subdetectors...)
+}
 
-    //check watchlist
-    flowBucket, inWatchlist := cd.watchlist[flowID]
-
-    // If a flow is already in the watchlist, update its leaky bucket or purge it if expired
-    if inWatchlist {
-        if (t - flowBucket.firstTimestamp > cd.watchlistTimeout) {
-            delete(cd.watchlist, flowID)
-        } else {
-            //fmt.Println("Update leaky bucket for flow...")
-            flowBucket.count += size
-            legitimateTraffic := uint32(float64(t-flowBucket.lastTimestamp) * cd.gamma)
-            if (flowBucket.count > legitimateTraffic){
-                flowBucket.count -= legitimateTraffic
-            } else {
-                flowBucket.count = 0
-            }
-            flowBucket.lastTimestamp = t
-            //fmt.Println("Update .")
-
-            if (float64(flowBucket.count) > cd.beta) {
-                return true
-            }
+//returns the number of packets of unwatched flows every subdetector
+//flagged, in the order of the subdetectors
+func (cd *ClefDtctr) GetDetections() []uint64 {
+    return append([]uint64(nil), cd.detections...)
+}
+
+//how flagged flows get on a full watchlist, RejectNew by default
+func (cd *ClefDtctr) SetEvictionPolicy(policy EvictionPolicy) {
+    cd.watchlist.setPolicy(policy)
+}
+
+func (cd *ClefDtctr) GetEvictionPolicy() EvictionPolicy {
+    return cd.watchlist.policy
+}
+
+//removes the flows whose time in the watchlist is over. The flows are in
+//insertion order, so this stops at the first flow that is still watched.
+func (cd *ClefDtctr) expireWatchlist(t time.Duration) {
+    wl := cd.watchlist
+    for wl.head >= 0 &&
+            t - wl.entries[wl.head].firstTimestamp > cd.watchlistTimeout {
+        cd.release(wl.head)
+    }
+}
+
+func (cd *ClefDtctr) release(i int) {
+    if !cd.watchlist.entries[i].blocked {
+        cd.WatchlistReleased++
+    }
+    cd.watchlist.remove(i)
+}
+
+//adds a packet to the leaky bucket in slot i, true if the bucket
+//overflows (the flow sends more than gamma*t + beta since it is watched)
+func (cd *ClefDtctr) enforce(i int, size uint32, t time.Duration) bool {
+    bucket := &cd.watchlist.entries[i].leakyBucket
+    bucket.count -= float64(t - bucket.lastTimestamp)*cd.gamma
+    if bucket.count < 0 {
+        bucket.count = 0
+    }
+    bucket.count += float64(size)
+    bucket.lastTimestamp = t
+    cd.watchlist.fix(i)
+    if bucket.count > cd.beta {
+        if !bucket.blocked {
+            cd.WatchlistBlocked++
         }
+        bucket.blocked = true
+        return true
     }
+    return false
+}
 
-    //create pktTriple
-    pkt := pktTriple{flowID, size, t}
 
-    //stuff pkt in channels
-    cd.packetsForEardet <- pkt
-    cd.packetsForRlfd1 <- pkt
-    cd.packetsForRlfd2 <- pkt
+//Flows flagged by the quorum of subdetectors are put on the watchlist and
+//checked with an exact leaky bucket until the watchlist timeout. They are
+//blocked only if they exceed the flow spec, and released otherwise.
+//Packets must come in time order.
+func (cd *ClefDtctr) Detect(flowID uint32, size uint32, t time.Duration) bool {
+    pkt := Packet{flowID, size, t}
+    //the subdetectors see all packets on the link
+    cd.subdetect(pkt)
+    return cd.judge(pkt)
+}
+
+//decides on a packet given the subdetectors that flagged it in
+//cd.flagged
+func (cd *ClefDtctr) judge(pkt Packet) bool {
+    flowID, size, t := pkt.FlowID, pkt.Size, pkt.T
 
-    //get results
-    r1 := <-cd.resultsEardet
-    r2 := <-cd.resultsRlfd1
-    r3 := <-cd.resultsRlfd2
-    detected := r1 || r2 || r3
+    //check watchlist
+    cd.expireWatchlist(t)
+    slot := cd.watchlist.find(flowID)
 
-    if (r1) {cd.EdBlocked++}
-    if (r2) {cd.Rd1Blocked++}
-    if (r3) {cd.Rd2Blocked++}
+    // A watched flow is judged by its leaky bucket only
+    if slot >= 0 {
+        return cd.enforce(slot, size, t)
+    }
 
-    // Insert flow into watchlist
-    if detected && !inWatchlist {
-        // If we have to insert a flow into the watchlist and there is too little space,
-        //  let's see if there are expired flow entries in the watchlist
-        if (uint32(len(cd.watchlist)) > cd.maxWatchlistSize) {
-            cd.cleanupWatchlist(t)
+    votes := 0
+    for i, f := range cd.flagged {
+        if f {
+            cd.detections[i]++
+            votes++
         }
-        //cd.watchlist[flowID] = &leakyBucket{firstTimestamp: t}
-        return true
+    }
+    if cd.quorum > 1 {
+        votes = cd.countVotes(flowID, t)
+    }
+    if votes < cd.quorum {
+        return false
+    }
+    if cd.votes != nil {
+        delete(cd.votes, flowID)
     }
 
-    return false
+    // Insert flow into watchlist, expired flows are already gone, so
+    // make room according to the eviction policy
+    if cd.watchlist.full() {
+        victim := cd.watchlist.victim()
+        if victim < 0 {
+            // no room to watch the flow, block it right away
+            cd.WatchlistFull++
+            return true
+        }
+        cd.WatchlistEvicted++
+        cd.watchlist.remove(victim)
+    }
+    return cd.enforce(cd.watchlist.insert(flowID, t), size, t)
     
 }
 
+//records the subdetectors that flagged the current packet and returns how
+//many flagged the flow within the vote window
+func (cd *ClefDtctr) countVotes(flowID uint32, t time.Duration) int {
+    cd.purgeVotes(t)
+    fv := cd.votes[flowID]
+    for i, f := range cd.flagged {
+        if !f {
+            continue
+        }
+        if fv == nil {
+            fv = &flowVotes{make([]bool, len(cd.flagged)),
+                make([]time.Duration, len(cd.flagged)), t}
+            cd.votes[flowID] = fv
+        }
+        fv.flagged[i] = true
+        fv.last[i] = t
+        fv.newest = t
+    }
+    if fv == nil {
+        return 0
+    }
+    votes := 0
+    for i, f := range fv.flagged {
+        if f && t - fv.last[i] <= cd.voteWindow {
+            votes++
+        }
+    }
+    return votes
+}
+
+//forgets the flows without a vote in the window, once per window
+func (cd *ClefDtctr) purgeVotes(t time.Duration) {
+    if t - cd.lastVotePurge <= cd.voteWindow {
+        return
+    }
+    for flowID, fv := range cd.votes {
+        if t - fv.newest > cd.voteWindow {
+            delete(cd.votes, flowID)
+        }
+    }
+    cd.lastVotePurge = t
+}
+
+//true if the flow is on the watchlist
+func (cd *ClefDtctr) IsWatched(flowID uint32) bool {
+    return cd.watchlist.find(flowID) >= 0
+}
+
 func (cd *ClefDtctr) GetBlacklist() *cuckoo.CuckooTable {
     return cd.blacklist
 }
@@ -190,17 +384,14 @@ func (cd *ClefDtctr) SetBlacklist(blacklist *cuckoo.CuckooTable) {
 }
 
 func (cd *ClefDtctr) GetWatchlistSize() uint32 {
-    return uint32(len(cd.watchlist))
-}
-
-func eardetWorker(dtctr *eardet.EardetDtctr, packets <-chan pktTriple, results chan<- bool) {
-    for p := range packets {
-        results <- dtctr.Detect(p.flowID, p.size, p.t)
-    }
+    return uint32(cd.watchlist.len())
 }
 
-func rlfdWorker(dtctr *rlfd.RlfdDtctr, packets <-chan pktTriple, results chan<- bool) {
+func subdetectorWorker(dtctr Subdetector, packets <-chan Packet,
+        results chan<- bool, wg *sync.WaitGroup) {
+    defer wg.Done()
+    defer close(results)
     for p := range packets {
-        results <- dtctr.Detect(p.flowID, p.size, p.t)
+        results <- dtctr.Detect(p.FlowID, p.Size, p.T)
     }
 }
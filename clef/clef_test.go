@@ -1,10 +1,386 @@
 package clef
 
 import (
+    "math/rand"
+    "reflect"
+    "runtime"
     "testing"
     "fmt"
+    "time"
+
+    "github.com/hosslen/lfd/eardet"
+    "github.com/hosslen/lfd/rlfd"
+)
+
+//flow spec of the tests: 1B/ns, 2000B
+const (
+    beta = 2000
+    gamma = 1.0
 )
 
+//CLEF whose EARDet flags every packet above 1000B
+func newTestDtctr(t *testing.T, maxWatchlistSize uint32) *ClefDtctr {
+    ed := eardet.NewEardetDtctr(4, 100, 1000, 10)
+    twin, err := rlfd.NewTwinRlfdDtctr(beta, gamma, 1, 2, 2, 4, 2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cd, err := NewClefDtctr(ed, twin, gamma, beta, maxWatchlistSize, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return cd
+}
+
 func TestDoNothing(t *testing.T) {
     fmt.Println("Do nothing ...")
-}
\ No newline at end of file
+}
+
+//a flagged flow that stays within the flow spec is watched, not blocked
+func TestWatchlistKeepsSmallFlow(t *testing.T) {
+    cd := newTestDtctr(t, 10)
+    defer cd.Close()
+
+    flowID := uint32(42)
+    if cd.Detect(flowID, 1500, 0) {
+        t.Errorf("flow blocked on its first packet")
+    }
+    if !cd.IsWatched(flowID) {
+        t.Fatalf("flagged flow not on the watchlist")
+    }
+    if cd.GetWatchlistSize() != 1 {
+        t.Errorf("watchlist size is %d, expected 1", cd.GetWatchlistSize())
+    }
+    //1500B have leaked out after 1500ns
+    if cd.Detect(flowID, 1500, time.Duration(1500)) {
+        t.Errorf("flow within the flow spec blocked")
+    }
+
+    //after the timeout the flow is released
+    cd.expireWatchlist(100*cd.watchlistTimeout)
+    if cd.IsWatched(flowID) {
+        t.Errorf("flow still watched after the timeout")
+    }
+    if cd.WatchlistReleased != 1 || cd.WatchlistBlocked != 0 {
+        t.Errorf("released %d, blocked %d flows, expected 1 and 0",
+            cd.WatchlistReleased, cd.WatchlistBlocked)
+    }
+}
+
+//a flagged flow above the flow spec is blocked by its leaky bucket
+func TestWatchlistBlocksLargeFlow(t *testing.T) {
+    cd := newTestDtctr(t, 10)
+    defer cd.Close()
+
+    flowID := uint32(42)
+    if cd.Detect(flowID, 1500, 0) {
+        t.Errorf("flow blocked on its first packet")
+    }
+    //only 100B have leaked out, 2900B > beta
+    if !cd.Detect(flowID, 1500, time.Duration(100)) {
+        t.Errorf("flow above the flow spec not blocked")
+    }
+    if cd.WatchlistBlocked != 1 {
+        t.Errorf("blocked %d flows, expected 1", cd.WatchlistBlocked)
+    }
+
+    //blocked flows do not count as released
+    cd.expireWatchlist(100*cd.watchlistTimeout)
+    if cd.WatchlistReleased != 0 {
+        t.Errorf("released %d flows, expected 0", cd.WatchlistReleased)
+    }
+}
+
+//without room on the watchlist, flagged flows are blocked right away
+func TestWatchlistFull(t *testing.T) {
+    cd := newTestDtctr(t, 0)
+    defer cd.Close()
+
+    if !cd.Detect(uint32(42), 1500, 0) {
+        t.Errorf("flagged flow not blocked with a full watchlist")
+    }
+    if cd.WatchlistFull != 1 || cd.GetWatchlistSize() != 0 {
+        t.Errorf("%d flows blocked for a full watchlist, %d watched, expected 1 and 0",
+            cd.WatchlistFull, cd.GetWatchlistSize())
+    }
+}
+
+//flows leave the watchlist in the order they were inserted
+func TestWatchlistExpiry(t *testing.T) {
+    cd := newTestDtctr(t, 10)
+    defer cd.Close()
+
+    for i, ts := range []time.Duration{0, 10, 20} {
+        cd.Detect(uint32(i + 1), 1500, ts)
+    }
+    cd.expireWatchlist(15 + cd.watchlistTimeout)
+    if cd.IsWatched(1) || cd.IsWatched(2) || !cd.IsWatched(3) {
+        t.Errorf("watched flows after expiry: %v %v %v, expected false false true",
+            cd.IsWatched(1), cd.IsWatched(2), cd.IsWatched(3))
+    }
+    if cd.WatchlistReleased != 2 || cd.GetWatchlistSize() != 1 {
+        t.Errorf("released %d flows, %d watched, expected 2 and 1",
+            cd.WatchlistReleased, cd.GetWatchlistSize())
+    }
+}
+
+//the eviction policies pick the flow that makes room for a new one
+func TestWatchlistEviction(t *testing.T) {
+    tests := []struct {
+        policy EvictionPolicy
+        evicted uint32
+        full uint32
+        watched [3]bool
+    }{
+        {RejectNew, 0, 1, [3]bool{true, true, false}},
+        {EvictOldest, 1, 0, [3]bool{false, true, true}},
+        {EvictLowest, 1, 0, [3]bool{true, false, true}},
+    }
+    for _, test := range tests {
+        cd := newTestDtctr(t, 2)
+        cd.SetEvictionPolicy(test.policy)
+        cd.Detect(1, 1500, 0)
+        //the bucket of flow 2 is lower although it is newer
+        cd.Detect(2, 1100, 1)
+        blocked := cd.Detect(3, 1500, 2)
+        if blocked != (test.policy == RejectNew) {
+            t.Errorf("%v: new flow blocked: %v", test.policy, blocked)
+        }
+        for i, w := range test.watched {
+            if cd.IsWatched(uint32(i + 1)) != w {
+                t.Errorf("%v: flow %d watched: %v, expected %v",
+                    test.policy, i + 1, !w, w)
+            }
+        }
+        if cd.WatchlistEvicted != test.evicted || cd.WatchlistFull != test.full {
+            t.Errorf("%v: %d flows evicted, %d rejected, expected %d and %d",
+                test.policy, cd.WatchlistEvicted, cd.WatchlistFull,
+                test.evicted, test.full)
+        }
+        cd.Close()
+    }
+}
+
+func TestParseEvictionPolicy(t *testing.T) {
+    for _, p := range []EvictionPolicy{RejectNew, EvictOldest, EvictLowest} {
+        if q, err := ParseEvictionPolicy(p.String()); err != nil || q != p {
+            t.Errorf("parsed %v as %v, %v", p, q, err)
+        }
+    }
+    if _, err := ParseEvictionPolicy("random"); err == nil {
+        t.Errorf("unknown policy accepted")
+    }
+}
+
+//every execution mode blocks the same packets
+func TestExecutionModes(t *testing.T) {
+    r := rand.New(rand.NewSource(1))
+    pkts := make([]Packet, 5000)
+    ts := time.Duration(0)
+    for i := range pkts {
+        ts += time.Duration(r.Intn(400))
+        pkts[i] = Packet{uint32(r.Intn(20)), uint32(64 + r.Intn(1450)), ts}
+    }
+
+    var expected []bool
+    for _, mode := range []ExecutionMode{Concurrent, Synchronous, Batched} {
+        cd := newTestDtctr(t, 8)
+        cd.SetEvictionPolicy(EvictLowest)
+        cd.SetExecutionMode(mode)
+        results := make([]bool, len(pkts))
+        //single packets first, then batches of different sizes
+        for i := 0; i < 100; i++ {
+            results[i] = cd.Detect(pkts[i].FlowID, pkts[i].Size, pkts[i].T)
+        }
+        for i, n := 100, 1; i < len(pkts); i, n = i + n, n + 7 {
+            if i + n > len(pkts) {
+                n = len(pkts) - i
+            }
+            cd.DetectBatch(pkts[i:i + n], results[i:i + n])
+        }
+        cd.Close()
+
+        if expected == nil {
+            expected = results
+            blocked := 0
+            for _, b := range results {
+                if b {
+                    blocked++
+                }
+            }
+            if blocked == 0 || blocked == len(results) {
+                t.Fatalf("%d of %d packets blocked, the test needs some of both",
+                    blocked, len(results))
+            }
+        } else if !reflect.DeepEqual(results, expected) {
+            t.Errorf("%v mode blocks other packets than the concurrent mode", mode)
+        }
+    }
+}
+
+func TestParseExecutionMode(t *testing.T) {
+    for _, m := range []ExecutionMode{Concurrent, Synchronous, Batched} {
+        if n, err := ParseExecutionMode(m.String()); err != nil || n != m {
+            t.Errorf("parsed %v as %v, %v", m, n, err)
+        }
+    }
+    if _, err := ParseExecutionMode("parallel"); err == nil {
+        t.Errorf("unknown mode accepted")
+    }
+}
+
+//closing detectors in every mode leaves no goroutines behind
+func TestCloseLeaks(t *testing.T) {
+    before := runtime.NumGoroutine()
+    for i := 0; i < 300; i++ {
+        cd := newTestDtctr(t, 8)
+        mode := ExecutionMode(i % 3)
+        cd.SetExecutionMode(mode)
+        cd.Detect(uint32(i), 1500, time.Duration(i))
+        cd.Close()
+        //closing again and switching modes must neither panic nor restart
+        //workers
+        cd.Close()
+        CleanUpClefDtctr(cd)
+        cd.SetExecutionMode(Batched)
+    }
+    //a worker may still be returning after it signalled the wait group
+    deadline := time.Now().Add(time.Second)
+    for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond)
+    }
+    if after := runtime.NumGoroutine(); after > before {
+        t.Errorf("%d goroutines before, %d after closing all detectors",
+            before, after)
+    }
+}
+
+//flags the flows in flows, counts the packets it sees
+type stubDtctr struct {
+    flows map[uint32]bool
+    packets int
+}
+
+func (sd *stubDtctr) Detect(flowID uint32, size uint32, t time.Duration) bool {
+    sd.packets++
+    return sd.flows[flowID]
+}
+
+func (sd *stubDtctr) SetCurrentTime(t time.Duration) {}
+
+//a flow is watched once the quorum of subdetectors flags it
+func TestQuorum(t *testing.T) {
+    for _, mode := range []ExecutionMode{Concurrent, Synchronous, Batched} {
+        stubs := []*stubDtctr{
+            {flows: map[uint32]bool{1: true, 2: true, 3: true}},
+            {flows: map[uint32]bool{2: true, 3: true}},
+            {flows: map[uint32]bool{3: true}},
+        }
+        cd, err := NewCustomClefDtctr(
+            []Subdetector{stubs[0], stubs[1], stubs[2]},
+            gamma, beta, 10, time.Duration(1000), nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        cd.SetExecutionMode(mode)
+        if err := cd.SetQuorum(2); err != nil {
+            t.Fatal(err)
+        }
+        for flowID := uint32(0); flowID < 4; flowID++ {
+            cd.Detect(flowID, 100, time.Duration(flowID))
+        }
+        for flowID, w := range []bool{false, false, true, true} {
+            if cd.IsWatched(uint32(flowID)) != w {
+                t.Errorf("%v: flow %d watched: %v, expected %v",
+                    mode, flowID, !w, w)
+            }
+        }
+        if !reflect.DeepEqual(cd.GetDetections(), []uint64{3, 2, 1}) {
+            t.Errorf("%v: detections %v, expected [3 2 1]", mode,
+                cd.GetDetections())
+        }
+        for i, sd := range stubs {
+            if sd.packets != 4 {
+                t.Errorf("%v: subdetector %d saw %d packets, expected 4",
+                    mode, i, sd.packets)
+            }
+        }
+        if err := cd.SetQuorum(4); err == nil {
+            t.Errorf("%v: quorum above the number of subdetectors accepted", mode)
+        }
+        cd.Close()
+    }
+
+    if _, err := NewCustomClefDtctr(nil, gamma, beta, 10, 1000, nil); err == nil {
+        t.Errorf("CLEF without subdetectors accepted")
+    }
+    //nil pointers must be caught here, not in a worker
+    var sd *stubDtctr
+    if _, err := NewCustomClefDtctr([]Subdetector{sd}, gamma, beta, 10, 1000, nil); err == nil {
+        t.Errorf("nil subdetector accepted")
+    }
+    twin, err := rlfd.NewTwinRlfdDtctr(beta, gamma, 1, 2, 2, 4, 2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var ed *eardet.EardetDtctr
+    if _, err := NewClefDtctr(ed, twin, gamma, beta, 10, nil); err == nil {
+        t.Errorf("CLEF without EARDet accepted")
+    }
+}
+
+//stubDtctr with a round, like RLFD
+type roundStubDtctr struct {
+    stubDtctr
+    round time.Duration
+}
+
+func (sd *roundStubDtctr) GetRoundDuration() time.Duration {
+    return sd.round
+}
+
+//the subdetectors of a quorum may flag different packets of a flow, as
+//long as they do so within the vote window
+func TestQuorumAcrossPackets(t *testing.T) {
+    a := &stubDtctr{flows: map[uint32]bool{}}
+    b := &roundStubDtctr{stubDtctr{flows: map[uint32]bool{}}, 3000}
+    cd, err := NewCustomClefDtctr([]Subdetector{a, b}, gamma, beta, 10,
+        time.Duration(1000), nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer cd.Close()
+    cd.SetExecutionMode(Synchronous)
+    if err := cd.SetQuorum(2); err != nil {
+        t.Fatal(err)
+    }
+    //votes last a round of the slowest subdetector
+    if cd.GetVoteWindow() != 3000 {
+        t.Errorf("vote window %v, expected 3000ns", cd.GetVoteWindow())
+    }
+
+    //a flags flows 1 and 2, b flags them later
+    a.flows[1], a.flows[2] = true, true
+    cd.Detect(1, 100, 0)
+    cd.Detect(2, 100, 0)
+    a.flows = map[uint32]bool{}
+    b.flows[1], b.flows[2] = true, true
+    if cd.IsWatched(1) || cd.IsWatched(2) {
+        t.Fatalf("flow watched with a single vote")
+    }
+    cd.Detect(1, 100, 2500)
+    if !cd.IsWatched(1) {
+        t.Errorf("flow flagged by both subdetectors within the window not watched")
+    }
+    //the vote of a is too old by now, and the vote of b alone is not enough
+    cd.Detect(2, 100, 3500)
+    if cd.IsWatched(2) {
+        t.Errorf("flow watched with a vote older than the window")
+    }
+    //the votes of flows gone from the window are dropped
+    b.flows = map[uint32]bool{}
+    cd.Detect(3, 100, 10000)
+    if len(cd.votes) != 0 {
+        t.Errorf("%d flows with votes, expected none", len(cd.votes))
+    }
+}
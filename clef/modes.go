@@ -0,0 +1,189 @@
+// This file contains the ways CLEF runs its subdetectors: one worker per
+// subdetector fed packet by packet, inline in the caller, or workers fed
+// with batches of packets. The results are the same in every mode.
+package clef
+
+import (
+    "fmt"
+    "sync"
+)
+
+//how CLEF runs its subdetectors
+type ExecutionMode int
+
+const (
+    //every packet goes over a channel to one goroutine per subdetector,
+    //the default
+    Concurrent ExecutionMode = iota
+    //the subdetectors are called inline, one after the other
+    Synchronous
+    //the packets of DetectBatch go to the subdetector goroutines as one
+    //slice
+    Batched
+)
+
+//a batch for one subdetector, which writes its result for pkts[i] to
+//results[i]
+type batchJob struct {
+    pkts []Packet
+    results []bool
+}
+
+//the mode named "concurrent", "sync" or "batched", "" is Concurrent
+func ParseExecutionMode(name string) (ExecutionMode, error) {
+    switch name {
+    case "", "concurrent":
+        return Concurrent, nil
+    case "sync":
+        return Synchronous, nil
+    case "batched":
+        return Batched, nil
+    }
+    return Concurrent, fmt.Errorf(
+        "unknown CLEF execution mode %q, want concurrent, sync or batched", name)
+}
+
+func (m ExecutionMode) String() string {
+    switch m {
+    case Synchronous:
+        return "sync"
+    case Batched:
+        return "batched"
+    }
+    return "concurrent"
+}
+
+//switches to another execution mode, must not be called while a packet
+//is being processed. After Close no goroutines are started anymore.
+func (cd *ClefDtctr) SetExecutionMode(mode ExecutionMode) {
+    cd.stopWorkers()
+    cd.mode = mode
+    if !cd.closed {
+        cd.startWorkers()
+    }
+}
+
+func (cd *ClefDtctr) GetExecutionMode() ExecutionMode {
+    return cd.mode
+}
+
+//starts the goroutines the execution mode needs
+func (cd *ClefDtctr) startWorkers() {
+    n := len(cd.subdetectors)
+    switch cd.mode {
+    case Concurrent:
+        cd.packets = make([]chan Packet, n)
+        cd.results = make([]chan bool, n)
+        for i, sd := range cd.subdetectors {
+            cd.packets[i] = make(chan Packet, 3)
+            cd.results[i] = make(chan bool, 3)
+            cd.workers.Add(1)
+            go subdetectorWorker(sd, cd.packets[i], cd.results[i], &cd.workers)
+        }
+    case Batched:
+        cd.batches = make([]chan batchJob, n)
+        cd.batchResults = make([][]bool, n)
+        cd.batchDone = make(chan bool, n)
+        for i, sd := range cd.subdetectors {
+            cd.batches[i] = make(chan batchJob, 1)
+            cd.workers.Add(1)
+            go batchWorker(sd, cd.batches[i], cd.batchDone, &cd.workers)
+        }
+    }
+}
+
+//ends the goroutines of the execution mode and waits for them. Only the
+//input channels are closed here, every worker closes its own results.
+func (cd *ClefDtctr) stopWorkers() {
+    for _, c := range cd.packets {
+        close(c)
+    }
+    for _, c := range cd.batches {
+        close(c)
+    }
+    cd.workers.Wait()
+
+    cd.packets, cd.results = nil, nil
+    cd.batches, cd.batchResults = nil, nil
+    //shared by the batch workers, so none of them closes it
+    cd.batchDone = nil
+}
+
+//runs the subdetectors on a packet, the ones that flagged it are set in
+//cd.flagged
+func (cd *ClefDtctr) subdetect(pkt Packet) {
+    switch cd.mode {
+    case Synchronous:
+        for i, sd := range cd.subdetectors {
+            cd.flagged[i] = sd.Detect(pkt.FlowID, pkt.Size, pkt.T)
+        }
+        return
+    case Batched:
+        cd.single[0] = pkt
+        cd.runBatch(cd.single[:])
+        cd.batchFlags(0)
+        return
+    }
+
+    //stuff pkt in channels
+    for _, c := range cd.packets {
+        c <- pkt
+    }
+
+    //get results
+    for i, c := range cd.results {
+        cd.flagged[i] = <-c
+    }
+}
+
+//hands pkts to the batch workers and waits until all of them are done
+func (cd *ClefDtctr) runBatch(pkts []Packet) {
+    for i := range cd.batches {
+        if cap(cd.batchResults[i]) < len(pkts) {
+            cd.batchResults[i] = make([]bool, len(pkts))
+        }
+        cd.batchResults[i] = cd.batchResults[i][:len(pkts)]
+        cd.batches[i] <- batchJob{pkts, cd.batchResults[i]}
+    }
+    for range cd.batches {
+        <-cd.batchDone
+    }
+}
+
+//sets cd.flagged to the subdetectors that flagged packet i of the last
+//batch
+func (cd *ClefDtctr) batchFlags(i int) {
+    for j, results := range cd.batchResults {
+        cd.flagged[j] = results[i]
+    }
+}
+
+//runs Detect on every packet of pkts and writes the results to results,
+//which must be at least as long. In the batched mode the subdetectors
+//get the whole slice at once, the results do not depend on the mode.
+func (cd *ClefDtctr) DetectBatch(pkts []Packet, results []bool) {
+    if cd.mode != Batched {
+        for i, p := range pkts {
+            results[i] = cd.Detect(p.FlowID, p.Size, p.T)
+        }
+        return
+    }
+    //the subdetectors see every packet no matter what the watchlist
+    //decides, so they can run ahead of it
+    cd.runBatch(pkts)
+    for i, p := range pkts {
+        cd.batchFlags(i)
+        results[i] = cd.judge(p)
+    }
+}
+
+func batchWorker(dtctr Subdetector, jobs <-chan batchJob, done chan<- bool,
+        wg *sync.WaitGroup) {
+    defer wg.Done()
+    for job := range jobs {
+        for i, p := range job.pkts {
+            job.results[i] = dtctr.Detect(p.FlowID, p.Size, p.T)
+        }
+        done <- true
+    }
+}
@@ -0,0 +1,224 @@
+// This file contains the CLEF watchlist: a fixed number of slots for the
+// leaky buckets of watched flows, a list of the slots in the order the
+// flows were inserted, so that expired flows are found at its head, and a
+// heap of the slots by bucket level for evicting the lowest bucket.
+package clef
+
+import (
+    "container/heap"
+    "fmt"
+    "time"
+)
+
+//what to do with a flagged flow when the watchlist is full
+type EvictionPolicy int
+
+const (
+    //block the new flow right away, the default
+    RejectNew EvictionPolicy = iota
+    //make room by releasing the flow that was inserted first
+    EvictOldest
+    //make room by releasing the flow with the lowest bucket level
+    EvictLowest
+)
+
+//the policy named "reject", "oldest" or "lowest", "" is RejectNew
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+    switch name {
+    case "", "reject":
+        return RejectNew, nil
+    case "oldest":
+        return EvictOldest, nil
+    case "lowest":
+        return EvictLowest, nil
+    }
+    return RejectNew, fmt.Errorf(
+        "unknown watchlist eviction policy %q, want reject, oldest or lowest", name)
+}
+
+func (p EvictionPolicy) String() string {
+    switch p {
+    case EvictOldest:
+        return "oldest"
+    case EvictLowest:
+        return "lowest"
+    }
+    return "reject"
+}
+
+type watchEntry struct {
+    leakyBucket
+    flowID uint32
+    //neighbouring slots in insertion order, -1 at the ends and for free
+    //slots
+    prev int
+    next int
+    //position in the heap by bucket level
+    heapPos int
+}
+
+type watchlist struct {
+    entries []watchEntry
+    //slot of every watched flow
+    slots map[uint32]int
+    //unused slots
+    free []int
+    //first and last inserted flow, -1 if empty
+    head int
+    tail int
+    //slots by bucket level, only kept up to date with EvictLowest
+    byLevel levelHeap
+    policy EvictionPolicy
+}
+
+func newWatchlist(capacity uint32, gamma float64) *watchlist {
+    wl := &watchlist{}
+    wl.entries = make([]watchEntry, capacity)
+    wl.slots = make(map[uint32]int, capacity)
+    wl.free = make([]int, capacity)
+    for i := range wl.free {
+        //hand out the low slots first
+        wl.free[i] = int(capacity) - 1 - i
+    }
+    wl.head, wl.tail = -1, -1
+    wl.byLevel = levelHeap{entries: wl.entries, gamma: gamma,
+        slots: make([]int, 0, capacity)}
+    return wl
+}
+
+func (wl *watchlist) len() int {
+    return len(wl.slots)
+}
+
+func (wl *watchlist) full() bool {
+    return len(wl.free) == 0
+}
+
+//the slot of flowID, -1 if it is not watched
+func (wl *watchlist) find(flowID uint32) int {
+    if i, ok := wl.slots[flowID]; ok {
+        return i
+    }
+    return -1
+}
+
+//puts flowID with an empty bucket at the end of the list, the watchlist
+//must not be full
+func (wl *watchlist) insert(flowID uint32, t time.Duration) int {
+    i := wl.free[len(wl.free) - 1]
+    wl.free = wl.free[:len(wl.free) - 1]
+    e := &wl.entries[i]
+    e.leakyBucket = leakyBucket{firstTimestamp: t, lastTimestamp: t}
+    e.flowID = flowID
+    e.prev, e.next = wl.tail, -1
+    if wl.tail >= 0 {
+        wl.entries[wl.tail].next = i
+    } else {
+        wl.head = i
+    }
+    wl.tail = i
+    wl.slots[flowID] = i
+    if wl.policy == EvictLowest {
+        if wl.byLevel.Len() == 0 {
+            wl.byLevel.epoch = t
+        }
+        heap.Push(&wl.byLevel, i)
+    }
+    return i
+}
+
+//frees slot i
+func (wl *watchlist) remove(i int) {
+    e := &wl.entries[i]
+    if e.prev >= 0 {
+        wl.entries[e.prev].next = e.next
+    } else {
+        wl.head = e.next
+    }
+    if e.next >= 0 {
+        wl.entries[e.next].prev = e.prev
+    } else {
+        wl.tail = e.prev
+    }
+    e.prev, e.next = -1, -1
+    if wl.policy == EvictLowest {
+        heap.Remove(&wl.byLevel, e.heapPos)
+    }
+    delete(wl.slots, e.flowID)
+    wl.free = append(wl.free, i)
+}
+
+//restores the order of slot i after its bucket has changed
+func (wl *watchlist) fix(i int) {
+    if wl.policy == EvictLowest {
+        heap.Fix(&wl.byLevel, wl.entries[i].heapPos)
+    }
+}
+
+//the slot to evict under the policy, -1 for RejectNew
+func (wl *watchlist) victim() int {
+    switch wl.policy {
+    case EvictOldest:
+        return wl.head
+    case EvictLowest:
+        if wl.byLevel.Len() > 0 {
+            return wl.byLevel.slots[0]
+        }
+    }
+    return -1
+}
+
+func (wl *watchlist) setPolicy(policy EvictionPolicy) {
+    wl.policy = policy
+    wl.byLevel.slots = wl.byLevel.slots[:0]
+    if policy != EvictLowest {
+        return
+    }
+    for i := wl.head; i >= 0; i = wl.entries[i].next {
+        wl.entries[i].heapPos = len(wl.byLevel.slots)
+        wl.byLevel.slots = append(wl.byLevel.slots, i)
+    }
+    if wl.head >= 0 {
+        wl.byLevel.epoch = wl.entries[wl.head].firstTimestamp
+    }
+    heap.Init(&wl.byLevel)
+}
+
+//slots as a min-heap by bucket level. All buckets leak at gamma, so
+//count + gamma*lastTimestamp orders them by level at any later time.
+type levelHeap struct {
+    slots []int
+    entries []watchEntry
+    gamma float64
+    //timestamps are taken relative to epoch to keep the keys precise
+    epoch time.Duration
+}
+
+func (h *levelHeap) key(i int) float64 {
+    e := &h.entries[i]
+    return e.count + float64(e.lastTimestamp - h.epoch)*h.gamma
+}
+
+func (h levelHeap) Len() int { return len(h.slots) }
+
+func (h levelHeap) Less(a, b int) bool {
+    return h.key(h.slots[a]) < h.key(h.slots[b])
+}
+
+func (h levelHeap) Swap(a, b int) {
+    h.slots[a], h.slots[b] = h.slots[b], h.slots[a]
+    h.entries[h.slots[a]].heapPos = a
+    h.entries[h.slots[b]].heapPos = b
+}
+
+func (h *levelHeap) Push(x interface{}) {
+    i := x.(int)
+    h.entries[i].heapPos = len(h.slots)
+    h.slots = append(h.slots, i)
+}
+
+func (h *levelHeap) Pop() interface{} {
+    i := h.slots[len(h.slots) - 1]
+    h.slots = h.slots[:len(h.slots) - 1]
+    return i
+}
@@ -0,0 +1,91 @@
+// This package implements Crypto-PAn, the prefix-preserving IP address
+// anonymisation scheme of Xu et al., on top of the AES primitive wrapped
+// by aeshash. Two addresses that share a k-bit prefix are mapped to two
+// anonymised addresses that share a k-bit prefix as well.
+package cryptopan
+
+import (
+    "fmt"
+    "net"
+
+    "github.com/hosslen/lfd/aeshash"
+)
+
+const (
+    //length of a Crypto-PAn key: AES key (16 bytes) | pad seed (16 bytes)
+    KeySize = 32
+)
+
+//---------------------------------------------------
+// Prefix-preserving anonymiser for IPv4 and IPv6 addresses
+type CryptoPAn struct {
+    aesh *aeshash.AESHasher
+    //encryption of the second half of the key, fills the bits of the
+    //cipher input that do not come from the address
+    pad [16]byte
+}
+
+//---------------------------------------------------
+// Object Instantiation, key must be KeySize bytes long
+func NewCryptoPAn(key []byte) (*CryptoPAn, error) {
+    if len(key) != KeySize {
+        return nil, fmt.Errorf(
+            "Crypto-PAn key must be %d bytes, not %d", KeySize, len(key))
+    }
+    cp := &CryptoPAn{}
+    cp.aesh = aeshash.NewAESHasher(key[:16])
+    var padSeed [16]byte
+    copy(padSeed[:], key[16:])
+    cp.pad = cp.aesh.Hash_block(&padSeed)
+    return cp, nil
+}
+
+//---------------------------------------------------
+// Anonymise an IPv4 address given as a (big-endian) integer
+func (cp *CryptoPAn) AnonymizeIPv4(addr uint32) uint32 {
+    var a [4]byte
+    a[0], a[1], a[2], a[3] =
+        byte(addr >> 24), byte(addr >> 16), byte(addr >> 8), byte(addr)
+    cp.anonymize(a[:])
+    return uint32(a[0])<<24 | uint32(a[1])<<16 | uint32(a[2])<<8 | uint32(a[3])
+}
+
+//---------------------------------------------------
+// Anonymise an IPv4 or IPv6 address, returns nil for invalid addresses
+func (cp *CryptoPAn) Anonymize(ip net.IP) net.IP {
+    if ip4 := ip.To4(); ip4 != nil {
+        out := make(net.IP, net.IPv4len)
+        copy(out, ip4)
+        cp.anonymize(out)
+        return out
+    }
+    if len(ip) != net.IPv6len {
+        return nil
+    }
+    out := make(net.IP, net.IPv6len)
+    copy(out, ip)
+    cp.anonymize(out)
+    return out
+}
+
+//---------------------------------------------------
+// Anonymise the address in addr (4 or 16 bytes) in place.
+// Bit i of the one-time pad is the first bit of the encryption of the
+// first i address bits, completed with the bits of pad from position i on.
+func (cp *CryptoPAn) anonymize(addr []byte) {
+    var otp [16]byte
+    input := cp.pad
+    nBits := len(addr)*8
+    for pos := 0; pos < nBits; pos++ {
+        // input holds the first pos bits of addr followed by pad
+        out := cp.aesh.Hash_block(&input)
+        otp[pos/8] |= (out[0] >> 7) << uint(7 - pos%8)
+
+        // take over address bit pos for the next round
+        mask := byte(0x80) >> uint(pos%8)
+        input[pos/8] = input[pos/8] &^ mask | addr[pos/8] & mask
+    }
+    for i := range addr {
+        addr[i] ^= otp[i]
+    }
+}
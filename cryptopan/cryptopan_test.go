@@ -0,0 +1,97 @@
+package cryptopan
+
+import (
+    "net"
+    "testing"
+)
+
+//key of the sample data that comes with the Crypto-PAn reference code
+var referenceKey = []byte{
+    21, 34, 23, 141, 51, 164, 207, 128, 19, 10, 91, 22, 73, 144, 125, 16,
+    216, 152, 143, 131, 121, 121, 101, 39, 98, 87, 76, 45, 42, 132, 34, 2}
+
+//-----------------------------------------------------------
+// Test against the sample data of the reference implementation
+func TestReferenceVectors(t *testing.T) {
+    var tests = []struct{
+        in string
+        want string
+    }{
+        {"128.11.68.132", "135.242.180.132"},
+        {"129.118.74.4", "134.136.186.123"},
+        {"130.132.252.244", "133.68.164.234"},
+        {"141.223.7.43", "141.167.8.160"},
+        {"141.233.145.108", "141.129.237.235"},
+        {"156.29.3.236", "147.225.12.42"},
+        {"165.247.96.84", "162.9.99.234"},
+        {"166.107.77.190", "160.132.178.185"},
+        {"192.102.249.13", "252.138.62.131"},
+    }
+    cp, err := NewCryptoPAn(referenceKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, test := range tests {
+        got := cp.Anonymize(net.ParseIP(test.in))
+        if !got.Equal(net.ParseIP(test.want)) {
+            t.Errorf("Anonymize(%s) = %s, should be %s", test.in, got, test.want)
+        }
+        ip4 := net.ParseIP(test.in).To4()
+        addr := uint32(ip4[0])<<24 | uint32(ip4[1])<<16 |
+            uint32(ip4[2])<<8 | uint32(ip4[3])
+        got4 := cp.AnonymizeIPv4(addr)
+        if net.IPv4(byte(got4 >> 24), byte(got4 >> 16), byte(got4 >> 8),
+            byte(got4)).String() != test.want {
+            t.Errorf("AnonymizeIPv4(%s) differs from Anonymize", test.in)
+        }
+    }
+}
+
+//-----------------------------------------------------------
+// Test that shared prefixes are preserved, also for IPv6
+func TestPrefixPreservation(t *testing.T) {
+    cp, err := NewCryptoPAn(referenceKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var tests = []struct{
+        a, b string
+        prefix int
+    }{
+        {"10.1.2.3", "10.1.2.200", 24},
+        {"10.1.2.3", "10.1.130.3", 16},
+        {"10.1.2.3", "138.1.2.3", 0},
+        {"2001:db8::1", "2001:db8::8000:1", 96},
+        {"2001:db8:1::1", "2001:db8:2::1", 32 + 14},
+    }
+    for _, test := range tests {
+        a := cp.Anonymize(net.ParseIP(test.a))
+        b := cp.Anonymize(net.ParseIP(test.b))
+        if got := commonPrefix(a, b); got != test.prefix {
+            t.Errorf("%s and %s share %d bits after anonymisation, should be %d",
+                test.a, test.b, got, test.prefix)
+        }
+    }
+}
+
+//-----------------------------------------------------------
+// Test that keys of the wrong length are rejected
+func TestKeySize(t *testing.T) {
+    if _, err := NewCryptoPAn(referenceKey[:16]); err == nil {
+        t.Errorf("16 byte key should be rejected")
+    }
+}
+
+func commonPrefix(a, b net.IP) int {
+    n := 0
+    for i := range a {
+        for bit := uint(0); bit < 8; bit++ {
+            mask := byte(0x80) >> bit
+            if a[i] & mask != b[i] & mask {
+                return n
+            }
+            n++
+        }
+    }
+    return n
+}
@@ -25,7 +25,6 @@ import (
     "fmt"
     "os"
     "runtime"
-    "unsafe"
     //"bitbucket/cuckoohash/murmur"
 )
 
@@ -75,9 +74,12 @@ func NewCuckoo() *CuckooTable {
 // getHashedKeys() generates the two hashed keys. Important to note is that
 // only one hash is generated. This hash is then split up into the two
 // hashed key values used for inserting/finding an object.
+// The hash input is the key followed by the seed of the table.
 func (c *CuckooTable) getHashedKeys(key uint32) (uint32, uint32) {
-    keyBytes := (*[8]byte)(unsafe.Pointer(&key))
-    hash := murmur3.Murmur3_32(keyBytes)
+    var keyBytes [8]byte
+    binary.LittleEndian.PutUint32(keyBytes[:4], key)
+    binary.LittleEndian.PutUint32(keyBytes[4:], c.seed)
+    hash := murmur3.Murmur3_32(&keyBytes)
     h1 := hash >> (32 - c.idxBytes)
     h2 := hash & uint32((1<<c.idxBytes)-1)
     return h1, h2
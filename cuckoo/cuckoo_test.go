@@ -97,6 +97,29 @@ func TestDelete(t *testing.T) {
     }
 }
 
+// The hashes depend on the key and the seed only, so a rehash moves the
+// entries.
+func TestHashedKeys(t *testing.T) {
+    c := NewCuckoo()
+    moved := 0
+    for i := 0; i < 1000; i++ {
+        h1, h2 := c.getHashedKeys(keys[i])
+        if g1, g2 := c.getHashedKeys(keys[i]); g1 != h1 || g2 != h2 {
+            t.Fatalf("key %d hashed to (%d, %d) and (%d, %d)",
+                keys[i], h1, h2, g1, g2)
+        }
+        seed := c.seed
+        c.resetSeed()
+        if g1, g2 := c.getHashedKeys(keys[i]); g1 != h1 || g2 != h2 {
+            moved++
+        }
+        c.seed = seed
+    }
+    if moved < 990 {
+        t.Errorf("%d of 1000 keys moved with a new seed", moved)
+    }
+}
+
 func TestMemory(t *testing.T) {
     runtime.GC()
     before := readAlloc()
@@ -0,0 +1,193 @@
+// Copyright 2016 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file contains the mapping of flows to EARDet counters: the bucket
+// hashers and the displacement of flows along cuckoo chains.
+package eardet
+
+import (
+    "crypto/rand"
+    "encoding/binary"
+    "fmt"
+
+    "github.com/hosslen/lfd/aeshash"
+)
+
+const (
+    //maximum number of candidate buckets per flow
+    MaxWays = 16
+    //length of the secret of a KeyedHasher
+    KeyedHasherKeySize = 16
+)
+
+//---------------------------------------------------
+// Chooses the candidate buckets of a flow
+type BucketHasher interface {
+    //writes the len(buckets) candidate buckets of flowID among numCounters
+    //buckets to buckets, the same flow always gets the same candidates
+    Buckets(flowID uint32, numCounters uint32, buckets []uint32)
+}
+
+//---------------------------------------------------
+// The original mapping: the low and the high 16 bits of the flow ID modulo
+// the number of counters. Supports exactly two candidates.
+type LegacyHasher struct{}
+
+func (LegacyHasher) Buckets(flowID uint32, numCounters uint32, buckets []uint32) {
+    buckets[0] = (flowID & 0xFFFF) % numCounters
+    buckets[1] = ((flowID & 0xFFFF0000) >> 16) % numCounters
+}
+
+//---------------------------------------------------
+// Keyed mapping: the flow ID is encrypted with AES under a secret key and
+// every 32 bits of the cipher block give one candidate, mapped to a bucket
+// by multiply-shift, which is unbiased for any number of counters up to
+// rounding. Without the key the candidates cannot be predicted.
+type KeyedHasher struct {
+    aesh *aeshash.AESHasher
+}
+
+// Object Instantiation, a nil key draws a random secret
+func NewKeyedHasher(key []byte) (*KeyedHasher, error) {
+    if key == nil {
+        key = make([]byte, KeyedHasherKeySize)
+        if _, err := rand.Read(key); err != nil {
+            return nil, err
+        }
+    }
+    if len(key) != KeyedHasherKeySize {
+        return nil, fmt.Errorf("bucket hash key must be %d bytes, not %d",
+            KeyedHasherKeySize, len(key))
+    }
+    return &KeyedHasher{aeshash.NewAESHasher(key)}, nil
+}
+
+func (kh *KeyedHasher) Buckets(flowID uint32, numCounters uint32, buckets []uint32) {
+    var input [16]byte
+    binary.LittleEndian.PutUint32(input[:4], flowID)
+    for i := 0; i < len(buckets); i += 4 {
+        //block number, for more than four candidates
+        input[4] = byte(i/4)
+        out := kh.aesh.Hash_block(&input)
+        for j := 0; j < 4 && i + j < len(buckets); j++ {
+            h := binary.LittleEndian.Uint32(out[4*j:])
+            buckets[i + j] = uint32((uint64(h)*uint64(numCounters)) >> 32)
+        }
+    }
+}
+
+//a bucket reached while searching for a displacement chain
+type chainNode struct {
+    bucket uint32
+    //index of the node whose flow would move into bucket, -1 for the
+    //candidates of the new flow
+    parent int
+}
+
+//---------------------------------------------------
+// Configure how flows are mapped to counters: hasher picks ways candidate
+// buckets per flow, and to make room for a new flow up to maxChain flows
+// may be moved to one of their other candidates (0 disables displacement).
+// The default is LegacyHasher with 2 ways and chains of 1.
+func (ed *EardetDtctr) SetBucketHashing(
+        hasher BucketHasher, ways int, maxChain int) error {
+    if hasher == nil {
+        return fmt.Errorf("no bucket hasher given")
+    }
+    if ways < 1 || ways > MaxWays {
+        return fmt.Errorf("number of candidate buckets must be in [1, %d], not %d",
+            MaxWays, ways)
+    }
+    if _, ok := hasher.(LegacyHasher); ok && ways != 2 {
+        return fmt.Errorf("the legacy bucket hash supports 2 candidate buckets only")
+    }
+    if maxChain < 0 {
+        return fmt.Errorf("displacement chain length must not be negative")
+    }
+    ed.hasher = hasher
+    ed.candidates = make([]uint32, ways)
+    ed.alternatives = make([]uint32, ways)
+    ed.maxChain = maxChain
+    return nil
+}
+
+func (ed *EardetDtctr) GetBucketHasher() BucketHasher {
+    return ed.hasher
+}
+
+//searches breadth-first for the shortest chain of at most maxChain moves
+//that frees one of the candidate buckets. Candidates and the other
+//buckets of their flows are tried in order. Returns the nodes and the
+//index of the empty bucket that ends the chain, or -1.
+func (ed *EardetDtctr) findChain() ([]chainNode, int) {
+    if ed.maxChain == 0 {
+        return nil, -1
+    }
+    ed.visitGen++
+    if ed.visitGen == 0 {
+        //wrapped around, forget all old marks
+        for i := range ed.visited {
+            ed.visited[i] = 0
+        }
+        ed.visitGen = 1
+    }
+    nodes := ed.chain[:0]
+    for _, b := range ed.candidates {
+        if ed.visited[b] != ed.visitGen {
+            ed.visited[b] = ed.visitGen
+            nodes = append(nodes, chainNode{b, -1})
+        }
+    }
+
+    start, end := 0, len(nodes)
+    for depth := 0; depth < ed.maxChain && start < end; depth++ {
+        for n := start; n < end; n++ {
+            ed.hasher.Buckets(ed.counters[nodes[n].bucket].flowID,
+                ed.numCounters, ed.alternatives)
+            for _, b := range ed.alternatives {
+                if ed.counters[b].count == ed.floor {
+                    nodes = append(nodes, chainNode{b, n})
+                    ed.chain = nodes
+                    return nodes, len(nodes) - 1
+                }
+                if ed.visited[b] != ed.visitGen {
+                    ed.visited[b] = ed.visitGen
+                    nodes = append(nodes, chainNode{b, n})
+                }
+            }
+        }
+        start, end = end, len(nodes)
+    }
+    ed.chain = nodes
+    return nodes, -1
+}
+
+//moves the flows along the chain ending in nodes[last] and returns the
+//freed candidate bucket
+func (ed *EardetDtctr) displace(nodes []chainNode, last int) *counter {
+    n := last
+    for nodes[n].parent >= 0 {
+        to := &ed.counters[nodes[n].bucket]
+        from := &ed.counters[nodes[nodes[n].parent].bucket]
+        to.flowID = from.flowID
+        to.count = from.count
+        to.virtual = from.virtual
+        ed.fixMin(to)
+        n = nodes[n].parent
+    }
+    e := &ed.counters[nodes[n].bucket]
+    e.count = ed.floor
+    ed.fixMin(e)
+    return e
+}
@@ -16,26 +16,32 @@
 package eardet
 
 import (
-    // "fmt"
+    "fmt"
     "time"
     "math"
+    "sort"
 
     "github.com/hosslen/lfd/cuckoo"
 )
 
-//TODO:
-//Change the way we find the new minimum
-
 const (
     //the number of counters in use (must be > 1)
     // numCounters uint32 = 128
     maxuint32 uint32 = 4294967295
+    //once the floor passes this value the counters are renormalised so that
+    //the floor is zero again, which leaves counts, threshold and maxValue
+    //plenty of headroom before they overflow
+    renormLimit uint32 = maxuint32/2
 )
 
 type counter struct {
     flowID uint32
     //count is always <= threshold + alpha
     count uint32
+    //position of the counter in counters
+    index uint32
+    //the counter is held by virtual traffic
+    virtual bool
 }
 
 type EardetDtctr struct {
@@ -55,6 +61,11 @@ type EardetDtctr struct {
     counters []counter
     //points to a bucket with count <= the counts of all other buckets
     minCounter *counter
+    //indices of the counters as a binary min-heap ordered by (count, index),
+    //so that minCounter is the first of the smallest counters
+    minHeap []uint32
+    //heapPos[i] is the position of counters[i] in minHeap
+    heapPos []uint32
     //the maximum value of count
     maxValue uint32
     //count == floor is regarded as being zero
@@ -66,12 +77,35 @@ type EardetDtctr struct {
 
     virtualID uint32
     maxVirtualPacketSize uint32
+    //set while virtual traffic is inserted
+    inVirtual bool
+    //virtual traffic of this size fills empty counters and empties them
+    //again, see insertVirtualTraffic
+    bulkVirtualTraffic uint64
+
+    //picks the candidate buckets of a flow
+    hasher BucketHasher
+    //length of the longest displacement chain
+    maxChain int
+    //scratch space for the candidates of the current flow and of the
+    //flows met while searching a displacement chain
+    candidates []uint32
+    alternatives []uint32
+    chain []chainNode
+    //visited[i] == visitGen if bucket i is in chain
+    visited []uint32
+    visitGen uint32
 
     //nanoseconds passed since start of interval
     currentTime time.Duration
 
     //carry-over
     co float64
+
+    //empty the counter of a flow once it is detected
+    removeOnDetect bool
+    //detected flows, their packets are not counted anymore (nil disables)
+    blacklist *cuckoo.CuckooTable
 }
 
 //constructors
@@ -81,7 +115,7 @@ func NewEardetDtctr(
     numCounters uint32, alpha uint32, beta_th uint32,
     linkCap float64) *EardetDtctr {
     ed := &EardetDtctr{}
-    ed.counters = make([]counter, numCounters)
+    ed.initCounters(numCounters)
 
     ed.alpha = alpha
     ed.beta_th = beta_th
@@ -89,26 +123,30 @@ func NewEardetDtctr(
     ed.linkCap = linkCap
     ed.numCounters = numCounters
 
-    //set minCounter to the last element of counters (all are initialized to 0 anyway)
-    ed.minCounter = &ed.counters[numCounters - 1]
     ed.maxValue = 0
     //set maxVirtualPacketSize
     ed.maxVirtualPacketSize = ed.beta_th - 1
+    ed.bulkVirtualTraffic = uint64(numCounters + 1) * uint64(ed.maxVirtualPacketSize)
 
     return ed
 }
 
 // beta_th = ((beta_l + (gamma_l * (alpha + beta_l)) / (linkCapacity / (numOfCounters + 1) - gamma_l)) + 1;
 // beta_h = 2 * beta_th + alpha;
+// Returns an error unless linkCapacity / (numOfCounters + 1) > gamma_l.
 func NewConfigedEardetDtctr(numCounters uint32, alpha uint32, beta_l uint32,
-    gamma_l float64, linkCap float64) *EardetDtctr{
+    gamma_l float64, linkCap float64) (*EardetDtctr, error) {
+    gamma_h := linkCap / float64(numCounters + 1)
+    if !(gamma_h > gamma_l) {
+        return nil, fmt.Errorf(
+            "%d counters give gamma_h = %gB/ns, which must be above gamma_l = %gB/ns",
+            numCounters, gamma_h, gamma_l)
+    }
     ed := &EardetDtctr{}
-    ed.counters = make([]counter, numCounters)
+    ed.initCounters(numCounters)
 
     ed.alpha = alpha
-    gamma_h := linkCap / float64(numCounters + 1)
-    ed.beta_th = uint32(float64(beta_l) + 
-        (gamma_l * float64(alpha + beta_l) / gamma_h - gamma_l) + 1.0)
+    ed.beta_th = thresholdFor(alpha, beta_l, gamma_l, gamma_h)
     ed.threshold = ed.beta_th
     ed.linkCap = linkCap
     ed.numCounters = numCounters
@@ -117,13 +155,104 @@ func NewConfigedEardetDtctr(numCounters uint32, alpha uint32, beta_l uint32,
     ed.beta_h = 2 * ed.beta_th + alpha
     ed.gamma_h = gamma_h
 
-    //set minCounter to the last element of counters (all are initialized to 0 anyway)
-    ed.minCounter = &ed.counters[numCounters - 1]
     ed.maxValue = 0
     //set maxVirtualPacketSize
     ed.maxVirtualPacketSize = ed.beta_th - 1
+    ed.bulkVirtualTraffic = uint64(numCounters + 1) * uint64(ed.maxVirtualPacketSize)
 
-    return ed
+    return ed, nil
+}
+
+//counter threshold that exempts flows below gamma_l*t + beta_l, needs
+//gamma_h > gamma_l
+func thresholdFor(alpha uint32, beta_l uint32, gamma_l float64,
+        gamma_h float64) uint32 {
+    return uint32(float64(beta_l) +
+        gamma_l * float64(alpha + beta_l) / (gamma_h - gamma_l) + 1.0)
+}
+
+//the guarantees of an EARDet configuration (rates in Byte/nanosec)
+type EardetGuarantees struct {
+    NumCounters uint32
+    Beta_th uint32
+    //flows below gamma_l*t + beta_l are never detected
+    Gamma_l float64
+    Beta_l uint32
+    //flows above gamma_h*t + beta_h are always detected
+    Gamma_h float64
+    Beta_h uint32
+    //flows sending at HighRate are detected within Incubation
+    HighRate float64
+    Incubation time.Duration
+}
+
+//the most counters NewTargetedEardetDtctr considers
+const maxTargetedCounters = 1 << 24
+
+// Creates an EARDet instance with the fewest counters that detects flows
+// sending at highRate within maxIncubation while never detecting flows
+// below the flow spec gamma_l*t + beta_l. Following the EARDet paper,
+// n counters give gamma_h = linkCap/(n + 1) and an incubation time of at
+// most (beta_th + alpha)/(highRate - gamma_h). More counters lower
+// gamma_h but raise beta_th, and as beta_th moves in integer steps the
+// bound can go up and down again, so every number of counters is tried
+// until gamma_h reaches gamma_l. Returns an error if none meets the target.
+func NewTargetedEardetDtctr(alpha uint32, beta_l uint32, gamma_l float64,
+        highRate float64, linkCap float64,
+        maxIncubation time.Duration) (*EardetDtctr, *EardetGuarantees, error) {
+    if !(gamma_l < highRate && highRate <= linkCap) {
+        return nil, nil, fmt.Errorf(
+            "need gamma_l < high rate <= link capacity, have %g, %g and %g",
+            gamma_l, highRate, linkCap)
+    }
+    //the smallest number of counters with gamma_h < highRate
+    n := uint32(math.Max(linkCap/highRate, 2))
+    best := math.Inf(1)
+    for ; n <= maxTargetedCounters; n++ {
+        gamma_h := linkCap/float64(n + 1)
+        if gamma_h <= gamma_l {
+            break
+        }
+        beta_th := thresholdFor(alpha, beta_l, gamma_l, gamma_h)
+        incubation := float64(beta_th + alpha)/(highRate - gamma_h)
+        if incubation <= float64(maxIncubation) {
+            ed, err := NewConfigedEardetDtctr(n, alpha, beta_l, gamma_l, linkCap)
+            if err != nil {
+                return nil, nil, err
+            }
+            return ed, &EardetGuarantees{
+                NumCounters: n,
+                Beta_th: ed.beta_th,
+                Gamma_l: gamma_l,
+                Beta_l: beta_l,
+                Gamma_h: ed.gamma_h,
+                Beta_h: ed.beta_h,
+                HighRate: highRate,
+                Incubation: time.Duration(incubation),
+            }, nil
+        }
+        best = math.Min(best, incubation)
+    }
+    if math.IsInf(best, 1) {
+        return nil, nil, fmt.Errorf(
+            "high rate %gB/ns is too close to gamma_l", highRate)
+    }
+    return nil, nil, fmt.Errorf(
+        "no number of counters detects %gB/ns within %v, the best is %v",
+        highRate, maxIncubation, time.Duration(best))
+}
+
+//allocates the counters and the heap over them
+func (ed *EardetDtctr) initCounters(numCounters uint32) {
+    ed.counters = make([]counter, numCounters)
+    ed.minHeap = make([]uint32, numCounters)
+    ed.heapPos = make([]uint32, numCounters)
+    ed.visited = make([]uint32, numCounters)
+    for i := uint32(0); i < numCounters; i++ {
+        ed.counters[i].index = i
+    }
+    ed.resetMin()
+    ed.SetBucketHashing(LegacyHasher{}, 2, 1)
 }
 
 func (ed *EardetDtctr) GetAlpha() uint32 {
@@ -154,6 +283,73 @@ func (ed *EardetDtctr) GetNumCounters() uint32 {
     return ed.numCounters
 }
 
+//a flow in an EARDet counter
+type CounterSnapshot struct {
+    //the bucket holding the flow
+    Bucket uint32
+    FlowID uint32
+    //count relative to the floor
+    Count uint32
+    //the counter is held by virtual traffic, not by a real flow
+    Virtual bool
+}
+
+//the state of the counter table
+type Snapshot struct {
+    //time of the last packet seen
+    Time time.Duration
+    //the non-empty counters in bucket order
+    Counters []CounterSnapshot
+    //floor, threshold and maxValue, all relative to zero
+    Floor uint32
+    Threshold uint32
+    MaxValue uint32
+}
+
+//takes a snapshot of the counter table
+func (ed *EardetDtctr) Snapshot() *Snapshot {
+    snap := &Snapshot{
+        Time: ed.currentTime,
+        Floor: ed.floor,
+        Threshold: ed.threshold,
+        MaxValue: ed.maxValue,
+    }
+    for i := range ed.counters {
+        c := &ed.counters[i]
+        if c.count > ed.floor {
+            snap.Counters = append(snap.Counters, CounterSnapshot{
+                c.index, c.flowID, c.count - ed.floor, c.virtual})
+        }
+    }
+    return snap
+}
+
+//returns the (at most) k real flows with the largest counts, largest
+//first; flows with equal counts are ordered by flow ID
+func (ed *EardetDtctr) TopK(k int) []CounterSnapshot {
+    return ed.Snapshot().TopK(k)
+}
+
+//returns the (at most) k real flows with the largest counts in the snapshot
+func (snap *Snapshot) TopK(k int) []CounterSnapshot {
+    top := make([]CounterSnapshot, 0, len(snap.Counters))
+    for _, c := range snap.Counters {
+        if !c.Virtual {
+            top = append(top, c)
+        }
+    }
+    sort.Slice(top, func(i, j int) bool {
+        if top[i].Count != top[j].Count {
+            return top[i].Count > top[j].Count
+        }
+        return top[i].FlowID < top[j].FlowID
+    })
+    if k < len(top) {
+        top = top[:k]
+    }
+    return top
+}
+
 //if the first packets timestamp is not equal to zero, use this
 func (ed *EardetDtctr) SetCurrentTime(now time.Duration) {
     ed.currentTime = now
@@ -161,6 +357,12 @@ func (ed *EardetDtctr) SetCurrentTime(now time.Duration) {
 
 //check packet
 func (ed *EardetDtctr) Detect(flowID uint32, size uint32, t time.Duration) bool {
+    //packets of blacklisted flows are dropped before they reach the link
+    if ed.blacklist != nil {
+        if _, ok := ed.blacklist.LookUp(flowID); ok {
+            return true
+        }
+    }
 
     if (ed.currentTime < t) {
         //advance currentTime
@@ -169,108 +371,187 @@ func (ed *EardetDtctr) Detect(flowID uint32, size uint32, t time.Duration) bool
         
         //calculate virtual traffic size
         virtualTrafficSizeRaw := float64(t - oldTime)*ed.linkCap
-        virtualTrafficSize := round(virtualTrafficSizeRaw + ed.co)
-        ed.co += virtualTrafficSizeRaw - float64(virtualTrafficSize)
+        var virtualTrafficSize uint32
+        if virtualTrafficSizeRaw + ed.co < float64(maxuint32) {
+            virtualTrafficSize = round(virtualTrafficSizeRaw + ed.co)
+            ed.co += virtualTrafficSizeRaw - float64(virtualTrafficSize)
+        } else {
+            //the conversion would overflow, such a gap drains every
+            //counter anyway
+            virtualTrafficSize = maxuint32
+            ed.co = 0
+        }
 
-        if virtualTrafficSize > ed.maxValue * ed.numCounters {
+        //no counter holds more than maxValue - floor above the floor
+        if uint64(virtualTrafficSize) >
+                uint64(ed.maxValue - ed.floor) * uint64(ed.numCounters) {
+            //the virtual traffic drains every counter, counts below the
+            //new floor would never be regarded as empty again
             ed.floor = ed.maxValue
             ed.threshold = ed.floor + ed.beta_th
+            for i := range ed.counters {
+                ed.counters[i].count = ed.floor
+            }
+            ed.resetMin()
         }
 
         //insert virtual traffic
-        for virtualTrafficSize >= ed.maxVirtualPacketSize {
-            virtualTrafficSize -= ed.maxVirtualPacketSize
-            ed.processPkt(ed.virtualID, ed.maxVirtualPacketSize)
-            ed.virtualID++
+        ed.insertVirtualTraffic(virtualTrafficSize)
+    }
+
+    //insert packet
+    if !ed.processPkt(flowID, size) {
+        return false
+    }
+    if ed.blacklist != nil {
+        ed.blacklist.Insert(flowID, 0)
+    }
+    return true
+
+}
+
+//inserts size bytes of virtual traffic as chunks of maxVirtualPacketSize
+//bytes with fresh flow IDs. Into empty counters, numCounters chunks fill
+//every counter and the next one empties them all again by raising the
+//floor by a chunk, as long as each run of numCounters + 1 chunks hits
+//every counter once. So while the counters are empty, whole runs of
+//bulkVirtualTraffic bytes are applied in one step where bulkPeriods
+//shows this to be exact, and the rest is inserted chunk by chunk.
+func (ed *EardetDtctr) insertVirtualTraffic(size uint32) {
+    chunk := ed.maxVirtualPacketSize
+    ed.inVirtual = true
+    for size >= chunk {
+        //no count is above the floor
+        if ed.maxValue == ed.floor && uint64(size) >= ed.bulkVirtualTraffic {
+            if periods := ed.bulkPeriods(size); periods > 0 {
+                ed.skipVirtualPeriods(periods)
+                size -= uint32(periods*ed.bulkVirtualTraffic)
+                continue
+            }
         }
-        if virtualTrafficSize > 0 {
-            ed.processPkt(ed.virtualID, virtualTrafficSize)
-            ed.virtualID++
+        size -= chunk
+        ed.processPkt(ed.virtualID, chunk)
+        ed.virtualID++
+    }
+    if size > 0 {
+        ed.processPkt(ed.virtualID, size)
+        ed.virtualID++
+    }
+    ed.inVirtual = false
+}
+
+//the number of runs of numCounters + 1 chunks in size that go into one
+//counter each. This holds for LegacyHasher only: consecutive flow IDs have
+//consecutive low 16 bits, which pick distinct first candidates as long as
+//they do not wrap, or wrap onto the same residues because numCounters is
+//a power of two up to 2^16. Chunks of other hashers collide, so none of
+//their runs are skipped.
+func (ed *EardetDtctr) bulkPeriods(size uint32) uint64 {
+    n := ed.numCounters
+    if _, ok := ed.hasher.(LegacyHasher); !ok || n > 1 << 16 {
+        return 0
+    }
+    periods := uint64(size)/ed.bulkVirtualTraffic
+    if n & (n - 1) != 0 {
+        //the low 16 bits must not wrap inside the skipped runs
+        room := uint64(1 << 16 - ed.virtualID & 0xFFFF)/uint64(n + 1)
+        if room < periods {
+            periods = room
         }
     }
+    return periods
+}
 
-    //insert packet
-    return ed.processPkt(flowID, size)
+//applies periods runs of numCounters + 1 chunks to empty counters, the
+//counters are left with the flow IDs of the last run as chunk by chunk
+func (ed *EardetDtctr) skipVirtualPeriods(periods uint64) {
+    //size/(numCounters + 1) at most, no overflow
+    ed.raiseFloor(uint32(periods)*ed.maxVirtualPacketSize)
+    ed.virtualID += uint32(periods)*(ed.numCounters + 1)
+    //chunk i of the last run takes the first candidate of its ID, and the
+    //last chunk takes the bucket of the first one
+    for id := ed.virtualID - ed.numCounters; id != ed.virtualID; id++ {
+        ed.hasher.Buckets(id, ed.numCounters, ed.candidates)
+        c := &ed.counters[ed.candidates[0]]
+        c.flowID = id
+        c.virtual = true
+    }
+}
 
+//raises the floor by raise, counts below the new floor are emptied
+func (ed *EardetDtctr) raiseFloor(raise uint32) {
+    //raise is at most maxuint32/3 < renormLimit, so after renormalising
+    //the floor stays at or below renormLimit
+    if ed.floor > renormLimit - raise {
+        ed.resetFloor()
+    }
+    ed.floor += raise
+    ed.threshold += raise
+    for i := range ed.counters {
+        if ed.counters[i].count < ed.floor {
+            ed.counters[i].count = ed.floor
+        }
+    }
+    if ed.maxValue < ed.floor {
+        ed.maxValue = ed.floor
+    }
+    ed.resetMin()
 }
 
 //add the packet to counters
-//Note: The assumption is no packet from an already blacklisted flow is passed as argument to this function.
-//If this assumption does not hold, a counter might overflow.
+//Note: Packets of already detected flows may be passed to this function,
+//counts saturate at maxuint32 instead of overflowing.
 func (ed *EardetDtctr) processPkt(flowID uint32, size uint32) bool {
-    //get the first bucket
-    index := (flowID & 0xFFFF) % ed.numCounters
-    c := &ed.counters[index]
+    //a packet raises the floor by at most size, so renormalising here keeps
+    //all counts below maxuint32
+    if ed.floor >= renormLimit {
+        ed.resetFloor()
+    }
 
-    tries := 0
-    var e, old_c *counter = nil, nil
+    ed.hasher.Buckets(flowID, ed.numCounters, ed.candidates)
+    var e *counter
 
-    //check if one of the two candidate buckets already belongs to this flow
-    for tries < 2 {
+    //check if one of the candidate buckets already belongs to this flow
+    for _, i := range ed.candidates {
+        c := &ed.counters[i]
         //if yes, increment the counter of that bucket
         if c.flowID == flowID {
-            c.count += size
-            if c == ed.minCounter {
-                ed.resetMin()
-            }
+            c.count = satAdd(c.count, size)
+            c.virtual = ed.inVirtual
+            ed.fixMin(c)
             if c.count > ed.maxValue {
                 ed.maxValue = c.count
             }
             if c.count > ed.threshold {
-                return true
+                return ed.detected(c)
             }
             return false
         //check if the bucket is empty and if it's the first empty bucket we encounter, store
         } else if c.count == ed.floor && e == nil {
             e = c
         }
-        tries++
-        if tries == 1 {
-            old_c = c
-            c = &ed.counters[((flowID & 0xFFFF0000) >> 16) % ed.numCounters]
-        }
     }
 
-    //check if it is possible to displace any of the counters blocking our
-    //two candidate buckets old_c and c
+    //check if it is possible to displace the counters blocking our
+    //candidate buckets
     if e == nil {
-        s := &ed.counters[(old_c.flowID & 0xFFFF) % ed.numCounters]
-        if s.count == ed.floor {
-            s.flowID = old_c.flowID
-            s.count = old_c.count
-            e = old_c
-        } else if s = &ed.counters[((old_c.flowID & 0xFFFF0000) >> 16) % ed.numCounters]; s.count == ed.floor {
-            s.flowID = old_c.flowID
-            s.count = old_c.count
-            e = old_c
-        } else if s = &ed.counters[(c.flowID & 0xFFFF) % ed.numCounters]; s.count == ed.floor {
-            s.flowID = c.flowID
-            s.count = c.count
-            e = c
-        } else if s = &ed.counters[((c.flowID & 0xFFFF0000) >> 16) % ed.numCounters]; s.count == ed.floor {
-            s.flowID = c.flowID
-            s.count = c.count
-            e = c
-        }
-        if e != nil {
-            e.count = ed.floor
-            ed.minCounter = e
+        if nodes, last := ed.findChain(); last >= 0 {
+            e = ed.displace(nodes, last)
         }
     }
 
     //check if we have found a (now) empty bucket
     if e != nil {
         e.flowID = flowID
-        e.count = ed.floor + size
-        if e == ed.minCounter {
-            ed.resetMin()
-        }
+        e.virtual = ed.inVirtual
+        e.count = satAdd(ed.floor, size)
+        ed.fixMin(e)
         if e.count > ed.maxValue {
             ed.maxValue = e.count
         }
         //check if the threshold is reached
         if e.count > ed.threshold {
-            return true
+            return ed.detected(e)
         }
         return false
     }
@@ -280,57 +561,144 @@ func (ed *EardetDtctr) processPkt(flowID uint32, size uint32) bool {
     ed.floor += m
     ed.threshold += m //adjust threshold
 
-    //check again if bucket is zero, insert if yes
-    if old_c.count == ed.floor {
-        old_c.flowID = flowID
-        old_c.count = ed.floor + (size - m)
-        if old_c == ed.minCounter {
-            ed.resetMin()
-        }
-        if old_c.count > ed.threshold {
-            return true
-        }
-    } else if c.count == ed.floor {
-        c.flowID = flowID
-        c.count = ed.floor + (size - m)
-        if c == ed.minCounter {
-            ed.resetMin()
-        }
-        if c.count > ed.threshold {
-            return true
+    //check again if a candidate bucket is zero, insert if yes
+    for _, i := range ed.candidates {
+        if c := &ed.counters[i]; c.count == ed.floor {
+            c.flowID = flowID
+            c.virtual = ed.inVirtual
+            c.count = satAdd(ed.floor, size - m)
+            ed.fixMin(c)
+            if c.count > ed.threshold {
+                return ed.detected(c)
+            }
+            return false
         }
     }
     return false
 }
 
-//calling this function will reset ed.minCounter
-//TODO: Change this
+//called when the count of c has passed the threshold, empties c if
+//removeOnDetect is set and the flow is real
+func (ed *EardetDtctr) detected(c *counter) bool {
+    if ed.removeOnDetect && !ed.inVirtual {
+        c.count = ed.floor
+        ed.fixMin(c)
+    }
+    return true
+}
+
+//rebuilds the heap from scratch and resets ed.minCounter,
+//needed only if counts were changed without calling fixMin
 func (ed *EardetDtctr) resetMin() {
-    c := &ed.counters[0]
-    m := c.count
-    for i := uint32(0); i < ed.numCounters; i++ {
-        if ed.counters[i].count < m {
-            c = &ed.counters[i]
-            m = ed.counters[i].count
+    n := uint32(len(ed.counters))
+    for i := uint32(0); i < n; i++ {
+        ed.minHeap[i] = i
+        ed.heapPos[i] = i
+    }
+    for i := n/2; i > 0; i-- {
+        ed.siftDown(i - 1)
+    }
+    ed.minCounter = &ed.counters[ed.minHeap[0]]
+}
+
+//restores the heap after the count of c has changed and resets
+//ed.minCounter, O(log numCounters)
+func (ed *EardetDtctr) fixMin(c *counter) {
+    pos := ed.heapPos[c.index]
+    if !ed.siftUp(pos) {
+        ed.siftDown(pos)
+    }
+    ed.minCounter = &ed.counters[ed.minHeap[0]]
+}
+
+//true if counters[i] comes before counters[j] in the heap
+func (ed *EardetDtctr) heapLess(i, j uint32) bool {
+    a, b := ed.counters[i].count, ed.counters[j].count
+    return a < b || (a == b && i < j)
+}
+
+func (ed *EardetDtctr) heapSwap(p, q uint32) {
+    ed.minHeap[p], ed.minHeap[q] = ed.minHeap[q], ed.minHeap[p]
+    ed.heapPos[ed.minHeap[p]] = p
+    ed.heapPos[ed.minHeap[q]] = q
+}
+
+//moves the element at pos up, returns true if it moved
+func (ed *EardetDtctr) siftUp(pos uint32) bool {
+    moved := false
+    for pos > 0 {
+        parent := (pos - 1)/2
+        if !ed.heapLess(ed.minHeap[pos], ed.minHeap[parent]) {
+            break
+        }
+        ed.heapSwap(pos, parent)
+        pos = parent
+        moved = true
+    }
+    return moved
+}
+
+//moves the element at pos down
+func (ed *EardetDtctr) siftDown(pos uint32) {
+    n := uint32(len(ed.minHeap))
+    for {
+        smallest := pos
+        if l := 2*pos + 1; l < n && ed.heapLess(ed.minHeap[l], ed.minHeap[smallest]) {
+            smallest = l
+        }
+        if r := 2*pos + 2; r < n && ed.heapLess(ed.minHeap[r], ed.minHeap[smallest]) {
+            smallest = r
+        }
+        if smallest == pos {
+            return
         }
+        ed.heapSwap(pos, smallest)
+        pos = smallest
     }
-    ed.minCounter = c
 }
 
-//resets the floor to zero
+//resets the floor to zero, counts below the floor count as zero
 func (ed *EardetDtctr) resetFloor() {
     for i := uint32(0); i < ed.numCounters; i++ {
-        ed.counters[i].count -= ed.floor
+        if ed.counters[i].count > ed.floor {
+            ed.counters[i].count -= ed.floor
+        } else {
+            ed.counters[i].count = 0
+        }
+    }
+    if ed.maxValue > ed.floor {
+        ed.maxValue -= ed.floor
+    } else {
+        ed.maxValue = 0
     }
     ed.threshold = ed.beta_th
     ed.floor = 0
+    //clamped counters may have changed their order
+    ed.resetMin()
+}
+
+// Once a flow is detected its counter is emptied, so that a flow that
+// keeps sending is detected again after it has passed the threshold anew.
+// Off by default: the counter stays above the threshold and every further
+// packet of the flow is reported.
+func (ed *EardetDtctr) SetRemoveOnDetect(remove bool) {
+    ed.removeOnDetect = remove
+}
+
+func (ed *EardetDtctr) GetRemoveOnDetect() bool {
+    return ed.removeOnDetect
 }
 
 func (ed *EardetDtctr) GetBlacklist() *cuckoo.CuckooTable {
-    return nil
+    return ed.blacklist
 }
 
-func (ed *EardetDtctr) SetBlacklist(blacklist *cuckoo.CuckooTable) {}
+// With a blacklist, detected flows are added to it and their later packets
+// are reported without being counted, as if they had been dropped before
+// the link. nil (the default) leaves filtering to the caller.
+func (ed *EardetDtctr) SetBlacklist(blacklist *cuckoo.CuckooTable) {
+    ed.blacklist = blacklist
+}
 
 
 func min(a, b uint32) uint32 {
@@ -340,6 +708,14 @@ func min(a, b uint32) uint32 {
     return b
 }
 
+//a + b, or maxuint32 if the sum overflows
+func satAdd(a, b uint32) uint32 {
+    if a > maxuint32 - b {
+        return maxuint32
+    }
+    return a + b
+}
+
 func round(val float64) uint32 {
     if (val - float64(uint32(val)) < 0.5) {
         return uint32(math.Floor(val))
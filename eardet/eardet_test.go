@@ -17,9 +17,12 @@ package eardet
 
 import (
     "fmt"
+    "math"
     "math/rand"
     "testing"
     "time"
+
+    "github.com/hosslen/lfd/cuckoo"
 )
 
 var (
@@ -27,9 +30,12 @@ var (
     zeroTime = time.Unix(0, 0)
     //to prevent compiler optimization at the wrong place
     resGlob bool
-    linkCapacity float32 = 1.25
+    linkCapacity float64 = 1.25
 )
 
+//the number of counters used in the tests
+const numCounters = uint32(128)
+
 //test the min function
 func TestMin(t *testing.T) {
     var tests = []struct{
@@ -122,6 +128,20 @@ func TestResetMin(t *testing.T) {
     }
 }
 
+//test that the heap keeps minCounter on the first smallest counter while
+//random packets are inserted, displaced and the floor is raised
+func TestMinCounterFollowsRandomPackets(t *testing.T) {
+    ed := NewEardetDtctr(128, 500, 5000, linkCapacity)
+    r := rand.New(rand.NewSource(1))
+    for i := 0; i < 100000; i++ {
+        ed.processPkt(r.Uint32() % 1024, uint32(r.Intn(500)) + 1)
+        if ed.minCounter != findMin(ed) {
+            t.Fatalf("packet %d: ed.minCounter=%p (count %d), should be %p (count %d)",
+             i, ed.minCounter, ed.minCounter.count, findMin(ed), findMin(ed).count)
+        }
+    }
+}
+
 func findMin(ed *EardetDtctr) *counter {
     temp := &ed.counters[0]
     for i := 0; i < len(ed.counters); i++ {
@@ -345,9 +365,10 @@ func TestInsertAfterRaisingFloor2(t *testing.T) {
 //this function should insert one virtual traffic packet before the real packet
 func TestDetectBasicInsert(t *testing.T) {
     ed := NewEardetDtctr(128, 500, 5000, 0.03)
+    //600ns at 0.03B/ns are 18B of virtual traffic
     ed.Detect(1, 300, 600)
-    if ed.counters[0].count != 19 {
-        t.Errorf("Virtual traffic should increment bucket 0 to 19 but has to %d", ed.counters[0].count)
+    if ed.counters[0].count != 18 {
+        t.Errorf("Virtual traffic should increment bucket 0 to 18 but has to %d", ed.counters[0].count)
     }
     if ed.counters[1 % numCounters].count != 300 {
         t.Errorf("Real packet should increment bucket 1 to 300 but has to %d", 
@@ -434,6 +455,572 @@ func TestDisplacement3(t *testing.T) {
     // printAllBuckets(ed)
 }
 
+//test that the counters are renormalised before the floor overflows
+func TestRenormalisation(t *testing.T) {
+    ed := NewEardetDtctr(4, 500, 1000, linkCapacity)
+    ed.floor = renormLimit
+    ed.threshold = ed.floor + ed.beta_th
+    for i := uint32(0); i < 4; i++ {
+        ed.counters[i].flowID = i
+        ed.counters[i].count = ed.floor + 100*i
+    }
+    ed.maxValue = ed.floor + 300
+    ed.resetMin()
+
+    ed.processPkt(3, 800)
+    if ed.floor != 0 || ed.threshold != ed.beta_th {
+        t.Errorf("floor=%d threshold=%d, should be 0 and %d",
+            ed.floor, ed.threshold, ed.beta_th)
+    }
+    for i := uint32(0); i < 3; i++ {
+        if ed.counters[i].count != 100*i {
+            t.Errorf("count of bucket %d is %d, should be %d",
+                i, ed.counters[i].count, 100*i)
+        }
+    }
+    if ed.counters[3].count != 1100 || ed.maxValue != 1100 {
+        t.Errorf("count of bucket 3 is %d (maxValue %d), should be 1100",
+            ed.counters[3].count, ed.maxValue)
+    }
+    if ed.minCounter != &ed.counters[0] {
+        t.Errorf("minCounter should be bucket 0")
+    }
+}
+
+//test that virtual traffic drains the counters once it exceeds what they
+//hold above the floor, however high the floor is
+func TestVirtualTrafficDrainsAboveFloor(t *testing.T) {
+    ed := NewEardetDtctr(4, 500, 1000, 1)
+    ed.floor = 10000
+    ed.threshold = ed.floor + ed.beta_th
+    for i := range ed.counters {
+        ed.counters[i].count = ed.floor
+    }
+    ed.counters[0].flowID = 42
+    ed.counters[0].count = ed.floor + 100
+    ed.maxValue = ed.floor + 100
+    ed.resetMin()
+
+    //1000B of virtual traffic are more than the 4*100B above the floor
+    ed.SetCurrentTime(0)
+    ed.Detect(7, 1, 1000)
+    if ed.floor < 10100 {
+        t.Errorf("floor is %d, should be at least 10100", ed.floor)
+    }
+    if top := ed.TopK(2); len(top) != 1 || top[0].FlowID != 7 {
+        t.Errorf("flows left in the counters: %v, should be flow 7 only", top)
+    }
+}
+
+//replay hours of traffic on a 100 Mbps link: one large flow at twice the
+//high rate that is readmitted after each detection (as if blacklisted for
+//a while) and a few flows far below the low rate. The floor passes
+//maxuint32 several times; every readmission of the large flow must be
+//detected quickly and the small flows never.
+func TestLongDuration(t *testing.T) {
+    if testing.Short() {
+        t.Skip("skipping long-duration replay in short mode")
+    }
+    const (
+        numCtrs = uint32(4)
+        linkCap = 0.0125
+        alpha = uint32(9000)
+        beta_th = uint32(100000)
+        duration = 2*time.Hour
+        blacklistTime = time.Minute
+        largeFlow = uint32(1)
+    )
+    ed := NewEardetDtctr(numCtrs, alpha, beta_th, linkCap)
+    //gamma_h = linkCap/(numCtrs + 1), send at twice that rate
+    largeGap := time.Duration(float64(alpha)*float64(numCtrs + 1)/(2*linkCap))
+    smallGap := time.Second
+
+    var now, nextLarge, nextSmall, blacklistedUntil, admitted time.Duration
+    var totalFloor uint64
+    lastFloor := uint32(0)
+    renorms, admissions, detections := 0, 1, 0
+    for now < duration {
+        if nextLarge <= nextSmall {
+            now = nextLarge
+            nextLarge += largeGap
+            if now < blacklistedUntil {
+                continue
+            }
+            if blacklistedUntil != 0 && admitted < blacklistedUntil {
+                admitted = now
+                admissions++
+            }
+            if ed.Detect(largeFlow, alpha, now) {
+                detections++
+                if now - admitted > time.Second {
+                    t.Errorf("large flow detected %v after readmission", now - admitted)
+                }
+                blacklistedUntil = now + blacklistTime
+            }
+        } else {
+            now = nextSmall
+            nextSmall += smallGap
+            for id := uint32(2); id < 5; id++ {
+                if ed.Detect(id << 16 | id, 1500, now) {
+                    t.Fatalf("small flow %d detected at %v", id, now)
+                }
+            }
+        }
+        if ed.floor < lastFloor {
+            renorms++
+            totalFloor += uint64(lastFloor)
+        }
+        lastFloor = ed.floor
+    }
+    totalFloor += uint64(lastFloor)
+    if renorms < 2 {
+        t.Errorf("counters renormalised %d times, the test should trigger it at least twice", renorms)
+    }
+    if totalFloor < 2*uint64(maxuint32) {
+        t.Errorf("floor advanced by %d only", totalFloor)
+    }
+    if detections != admissions {
+        t.Errorf("large flow admitted %d times but detected %d times", admissions, detections)
+    }
+}
+
+//test that raising the floor for long gaps in one step gives the same
+//detections and counters as inserting every chunk of the virtual traffic.
+//A few flows send above gamma_h, many more far below it, with long idle
+//periods in between.
+func TestVirtualTrafficBulkMatchesChunks(t *testing.T) {
+    kh, _ := NewKeyedHasher(nil)
+    for _, test := range []struct{
+        n uint32
+        hasher BucketHasher
+        ways int
+    }{
+        {8, LegacyHasher{}, 2},
+        {128, LegacyHasher{}, 2},
+        {1024, LegacyHasher{}, 2},
+        //runs of chunks must not wrap the low 16 bits of the flow IDs
+        {100, LegacyHasher{}, 2},
+        {1000, LegacyHasher{}, 2},
+        //keyed chunks collide, so they are never skipped
+        {64, kh, 2},
+        {100, kh, 3},
+    } {
+        n := test.n
+        name := fmt.Sprintf("n=%d %T", n, test.hasher)
+        const beta_th, alpha, size = uint32(3000), uint32(1500), uint32(1000)
+        linkCap := 1.25
+        bulk := NewEardetDtctr(n, alpha, beta_th, linkCap)
+        chunks := NewEardetDtctr(n, alpha, beta_th, linkCap)
+        chunks.bulkVirtualTraffic = math.MaxUint64
+        for _, ed := range []*EardetDtctr{bulk, chunks} {
+            if err := ed.SetBucketHashing(test.hasher, test.ways, 1); err != nil {
+                t.Fatal(err)
+            }
+            //keeps the counts low enough for the idle periods to drain them
+            ed.SetRemoveOnDetect(true)
+            //the flow IDs of the chunks wrap around early on
+            ed.virtualID = 0xFFFFE000
+        }
+        //the link is half busy outside of the idle periods, which last up
+        //to 10 times bulkVirtualTraffic
+        pktGap := time.Duration(float64(size)/(linkCap/2))
+        idle := int64(float64(10*bulk.bulkVirtualTraffic)/linkCap)
+        heavy := 8/float64(n + 1)
+        r := rand.New(rand.NewSource(int64(n)))
+
+        var now time.Duration
+        detected, longGaps := 0, 0
+        for i := 0; i < 20*int(n) + 5000; i++ {
+            now += pktGap
+            if r.Intn(500) == 0 {
+                now += time.Duration(r.Int63n(idle))
+            }
+            id := 4 + r.Uint32() % (4*n)
+            if p := r.Float64(); p < 4*heavy {
+                id = uint32(p/heavy)
+            }
+            vid := chunks.virtualID
+            a, b := bulk.Detect(id, size, now), chunks.Detect(id, size, now)
+            if a != b {
+                t.Fatalf("%s packet %d: detected %v, should be %v", name, i, a, b)
+            }
+            if a {
+                detected++
+            }
+            //more than one run of chunks into empty counters
+            if chunks.virtualID - vid > n + 1 {
+                longGaps++
+            }
+            if bulk.floor != chunks.floor || bulk.virtualID != chunks.virtualID {
+                t.Fatalf("%s packet %d: floor %d virtualID %d, should be %d and %d",
+                    name, i, bulk.floor, bulk.virtualID, chunks.floor, chunks.virtualID)
+            }
+            for j := range bulk.counters {
+                if c, d := bulk.counters[j], chunks.counters[j]; c != d {
+                    t.Fatalf("%s packet %d: bucket %d is %v, should be %v",
+                        name, i, j, c, d)
+                }
+            }
+        }
+        if detected == 0 {
+            t.Errorf("%s: no packet detected, the test needs some", name)
+        }
+        if longGaps < 5 {
+            t.Errorf("%s: %d long gaps only, the test needs more", name, longGaps)
+        }
+    }
+}
+
+//test that a displacement chain of two moves is used only if allowed
+func TestDisplacementChain(t *testing.T) {
+    for _, maxChain := range []int{1, 2} {
+        ed := NewEardetDtctr(8, 500, 1000, linkCapacity)
+        if err := ed.SetBucketHashing(LegacyHasher{}, 2, maxChain); err != nil {
+            t.Fatal(err)
+        }
+        //flow i sits in bucket i, its other bucket is i + 2
+        for i := uint32(0); i < 4; i++ {
+            ed.processPkt((i + 2) << 16 | i, 100)
+        }
+        //buckets 0 and 1, the flows there can only move to 2 and 3
+        ed.processPkt(0x00010000, 300)
+        if maxChain == 1 {
+            //buckets 4 to 7 are empty, so the floor cannot be raised either
+            for i := uint32(0); i < 8; i++ {
+                if ed.counters[i].flowID == 0x00010000 {
+                    t.Errorf("chain of 1: flow inserted into bucket %d", i)
+                }
+            }
+            continue
+        }
+        if ed.floor != 0 {
+            t.Errorf("chain of 2: floor is %d, should be 0", ed.floor)
+        }
+        want := []uint32{0x00010000, 0x00030001, 0x00020000, 0x00050003, 0x00040002}
+        for i, id := range want {
+            if ed.counters[i].flowID != id {
+                t.Errorf("chain of 2: bucket %d holds flow %x, should hold %x",
+                    i, ed.counters[i].flowID, id)
+            }
+        }
+        if ed.counters[0].count != 300 || ed.counters[4].count != 100 {
+            t.Errorf("chain of 2: counts %d and %d, should be 300 and 100",
+                ed.counters[0].count, ed.counters[4].count)
+        }
+    }
+}
+
+//test that the keyed hash is deterministic, depends on the key and
+//spreads flows evenly over a number of counters that is not a power of 2
+func TestKeyedHasher(t *testing.T) {
+    key := []byte("0123456789abcdef")
+    kh1, _ := NewKeyedHasher(key)
+    kh2, _ := NewKeyedHasher(key)
+    kh3, err := NewKeyedHasher(nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := NewKeyedHasher(key[:8]); err == nil {
+        t.Errorf("8 byte key should be rejected")
+    }
+
+    const n, flows = uint32(100), 100000
+    hist := make([]int, n)
+    b1, b2, b3 := make([]uint32, 6), make([]uint32, 6), make([]uint32, 6)
+    same := 0
+    for id := uint32(0); id < flows; id++ {
+        kh1.Buckets(id, n, b1)
+        kh2.Buckets(id, n, b2)
+        kh3.Buckets(id, n, b3)
+        for i := range b1 {
+            if b1[i] != b2[i] {
+                t.Fatalf("flow %d: candidates differ for the same key", id)
+            }
+            if b1[i] == b3[i] {
+                same++
+            }
+            hist[b1[i]]++
+        }
+    }
+    //about 1/n of the candidates coincide for different keys
+    if same > 2*6*flows/int(n) {
+        t.Errorf("%d of %d candidates equal for different keys", same, 6*flows)
+    }
+    mean := 6*flows/int(n)
+    for i, h := range hist {
+        if h < mean*9/10 || h > mean*11/10 {
+            t.Errorf("bucket %d chosen %d times, mean is %d", i, h, mean)
+        }
+    }
+}
+
+//test that flows stay in one of their candidates with d-way keyed hashing
+//and long displacement chains
+func TestKeyedDWay(t *testing.T) {
+    kh, _ := NewKeyedHasher(nil)
+    ed := NewEardetDtctr(100, 500, 100000, linkCapacity)
+    if err := ed.SetBucketHashing(kh, 4, 3); err != nil {
+        t.Fatal(err)
+    }
+    for i := uint32(0); i < 95; i++ {
+        ed.processPkt(i, 100 + i)
+    }
+    //with 4 ways and chains of 3 nearly all flows find a bucket without
+    //raising the floor
+    if ed.floor != 0 {
+        t.Errorf("floor is %d, should be 0", ed.floor)
+    }
+    buckets := make([]uint32, 4)
+    for i := range ed.counters {
+        c := &ed.counters[i]
+        if c.count == ed.floor {
+            continue
+        }
+        kh.Buckets(c.flowID, 100, buckets)
+        found := false
+        for _, b := range buckets {
+            found = found || b == uint32(i)
+        }
+        if !found {
+            t.Errorf("flow %d in bucket %d, candidates are %v", c.flowID, i, buckets)
+        }
+        if c.count != 100 + c.flowID {
+            t.Errorf("flow %d has count %d, should be %d", c.flowID, c.count, 100 + c.flowID)
+        }
+    }
+    if ed.minCounter != findMin(ed) {
+        t.Errorf("minCounter is not the smallest counter")
+    }
+}
+
+//test that invalid bucket hashing settings are rejected
+func TestSetBucketHashing(t *testing.T) {
+    ed := NewEardetDtctr(16, 500, 1000, linkCapacity)
+    kh, _ := NewKeyedHasher(nil)
+    var tests = []struct{
+        hasher BucketHasher
+        ways int
+        maxChain int
+        ok bool
+    }{
+        {LegacyHasher{}, 2, 0, true},
+        {LegacyHasher{}, 3, 1, false},
+        {kh, 3, 4, true},
+        {kh, 0, 1, false},
+        {kh, MaxWays + 1, 1, false},
+        {kh, 2, -1, false},
+        {nil, 2, 1, false},
+    }
+    for _, test := range tests {
+        err := ed.SetBucketHashing(test.hasher, test.ways, test.maxChain)
+        if (err == nil) != test.ok {
+            t.Errorf("SetBucketHashing(%T, %d, %d) returned %v",
+                test.hasher, test.ways, test.maxChain, err)
+        }
+    }
+}
+
+//test that snapshots list the non-empty counters relative to the floor
+//and that TopK orders the real flows by count
+func TestSnapshot(t *testing.T) {
+    ed := NewEardetDtctr(8, 500, 5000, 0.001)
+    ed.Detect(0x00010001, 300, 0)
+    ed.Detect(0x00020002, 700, 0)
+    ed.Detect(0x00030003, 300, 0)
+    //the first packets do not advance the time, so this adds 2100B of
+    //virtual traffic in bucket 0
+    ed.Detect(0x00040004, 200, 2100000)
+    ed.floor = 50
+    ed.threshold = 5050
+
+    snap := ed.Snapshot()
+    want := []CounterSnapshot{
+        {0, 0, 2050, true},
+        {1, 0x00010001, 250, false},
+        {2, 0x00020002, 650, false},
+        {3, 0x00030003, 250, false},
+        {4, 0x00040004, 150, false},
+    }
+    if len(snap.Counters) != len(want) {
+        t.Fatalf("snapshot has %d counters, should have %d: %v",
+            len(snap.Counters), len(want), snap.Counters)
+    }
+    for i := range want {
+        if snap.Counters[i] != want[i] {
+            t.Errorf("counter %d is %v, should be %v", i, snap.Counters[i], want[i])
+        }
+    }
+    if snap.Floor != 50 || snap.Threshold != 5050 || snap.MaxValue != 2100 {
+        t.Errorf("floor %d threshold %d maxValue %d, should be 50, 5050 and 2100",
+            snap.Floor, snap.Threshold, snap.MaxValue)
+    }
+
+    top := ed.TopK(3)
+    wantTop := []uint32{0x00020002, 0x00010001, 0x00030003}
+    if len(top) != len(wantTop) {
+        t.Fatalf("top 3 has %d flows", len(top))
+    }
+    for i := range wantTop {
+        if top[i].FlowID != wantTop[i] {
+            t.Errorf("flow %d of top 3 is %x, should be %x", i, top[i].FlowID, wantTop[i])
+        }
+    }
+    if top := ed.TopK(10); len(top) != 4 {
+        t.Errorf("top 10 has %d flows, should have the 4 real ones", len(top))
+    }
+}
+
+//test that beta_th follows the EARDet paper,
+//beta_l + gamma_l*(alpha + beta_l)/(gamma_h - gamma_l) + 1
+func TestConfigedBetaTh(t *testing.T) {
+    //2 counters on a link of 2.25B/ns give gamma_h = 0.75B/ns
+    ed, err := NewConfigedEardetDtctr(2, 1000, 2000, 0.25, 2.25)
+    if err != nil {
+        t.Fatal(err)
+    }
+    //2000 + 0.25*3000/0.5 + 1
+    if ed.GetBeta_th() != 3501 {
+        t.Errorf("beta_th is %d, should be 3501", ed.GetBeta_th())
+    }
+    if ed.GetBeta_h() != 2*3501 + 1000 || ed.GetGamma_h() != 0.75 {
+        t.Errorf("high-bandwidth threshold %g, %d, should be 0.75, 8002",
+            ed.GetGamma_h(), ed.GetBeta_h())
+    }
+    //gamma_h must be above gamma_l, 2 counters give 0.25B/ns on 0.75B/ns
+    if _, err := NewConfigedEardetDtctr(2, 1000, 2000, 0.25, 0.75); err == nil {
+        t.Errorf("gamma_h equal to gamma_l should be rejected")
+    }
+    if _, err := NewConfigedEardetDtctr(2, 1000, 2000, 0.5, 0.75); err == nil {
+        t.Errorf("gamma_h below gamma_l should be rejected")
+    }
+}
+
+//test the constructor for a maximum incubation time with the settings of
+//the synthetic trace: 1Gbps link, flow spec 12.5kB/s and 3028B, flows at
+//125kB/s must be caught within a second
+func TestTargetedEardetDtctr(t *testing.T) {
+    const (
+        linkCap = 0.125
+        gamma_l = 12500/1e9
+        highRate = 125000/1e9
+        alpha = uint32(1514)
+        beta_l = uint32(3028)
+    )
+    ed, g, err := NewTargetedEardetDtctr(
+        alpha, beta_l, gamma_l, highRate, linkCap, time.Second)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if g.Incubation > time.Second || g.NumCounters != ed.GetNumCounters() {
+        t.Errorf("%d counters give an incubation time of %v",
+            g.NumCounters, g.Incubation)
+    }
+    //beta_th = beta_l + gamma_l*(alpha + beta_l)/(gamma_h - gamma_l) + 1
+    gamma_h := linkCap/float64(g.NumCounters + 1)
+    beta_th := uint32(float64(beta_l) +
+        gamma_l*float64(alpha + beta_l)/(gamma_h - gamma_l) + 1)
+    if ed.GetBeta_th() != beta_th || g.Beta_th != beta_th {
+        t.Errorf("beta_th is %d, should be %d", ed.GetBeta_th(), beta_th)
+    }
+    if g.Gamma_h != gamma_h || g.Beta_h != 2*beta_th + alpha {
+        t.Errorf("high-bandwidth threshold %g, %d", g.Gamma_h, g.Beta_h)
+    }
+    //one counter less misses the target
+    gamma_h = linkCap/float64(g.NumCounters)
+    beta_th = uint32(float64(beta_l) +
+        gamma_l*float64(alpha + beta_l)/(gamma_h - gamma_l) + 1)
+    if float64(beta_th + alpha)/(highRate - gamma_h) <= 1e9 {
+        t.Errorf("%d counters are not the fewest", g.NumCounters)
+    }
+
+    //far below the best incubation time
+    if _, _, err := NewTargetedEardetDtctr(
+            alpha, beta_l, gamma_l, highRate, linkCap, time.Millisecond); err == nil {
+        t.Errorf("an incubation time of 1ms should not be possible")
+    }
+    if _, _, err := NewTargetedEardetDtctr(
+            alpha, beta_l, highRate, gamma_l, linkCap, time.Second); err == nil {
+        t.Errorf("gamma_l above the high rate should be rejected")
+    }
+}
+
+//test that the search goes on past a step of beta_th: on a link of 1B/ns
+//with gamma_l = 0.01B/ns, beta_l = 10B and alpha = 2B, flows at 0.5B/ns
+//are caught within 36.4ns by 6 counters (beta_th 11), 37.3ns by 7 (beta_th
+//12) and 36ns by 8
+func TestTargetedEardetDtctrStep(t *testing.T) {
+    ed, g, err := NewTargetedEardetDtctr(2, 10, 0.01, 0.5, 1, 36)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if g.NumCounters != 8 || ed.GetBeta_th() != 12 || g.Incubation != 36 {
+        t.Errorf("%d counters with beta_th %d give %v, should be 8, 12 and 36ns",
+            g.NumCounters, ed.GetBeta_th(), g.Incubation)
+    }
+}
+
+func TestRepeatOffenderSaturates(t *testing.T) {
+    ed := NewEardetDtctr(4, 1500, 5000, 0.001)
+    //a blacklisted flow that keeps sending without time passing
+    for i := 0; i < 3000; i++ {
+        if !ed.Detect(0x00010001, 1500000, 0) {
+            t.Fatalf("packet %d of the flow is not detected", i)
+        }
+    }
+    if c := ed.counters[1].count; c != maxuint32 {
+        t.Errorf("count is %d, should saturate at %d", c, maxuint32)
+    }
+    if ed.minCounter.count != 0 {
+        t.Errorf("min counter has count %d, should be 0", ed.minCounter.count)
+    }
+}
+
+func TestRemoveOnDetect(t *testing.T) {
+    ed := NewEardetDtctr(4, 1500, 5000, 0.001)
+    ed.SetRemoveOnDetect(true)
+    detections := 0
+    for i := 0; i < 20; i++ {
+        if ed.Detect(0x00010001, 1000, 0) {
+            detections++
+            if c := ed.counters[1].count; c != ed.floor {
+                t.Errorf("counter holds %d after detection, should be empty", c)
+            }
+        }
+    }
+    //the counter passes 5000 at every sixth packet
+    if detections != 3 {
+        t.Errorf("flow detected %d times, should be 3", detections)
+    }
+}
+
+func TestInternalBlacklist(t *testing.T) {
+    ed := NewEardetDtctr(4, 1500, 5000, 0.001)
+    ed.SetBlacklist(cuckoo.NewCuckoo())
+    for i := 0; i < 5; i++ {
+        if ed.Detect(0x00010001, 1000, 0) {
+            t.Fatalf("flow detected after %d packets", i + 1)
+        }
+    }
+    if !ed.Detect(0x00010001, 1000, 0) {
+        t.Fatalf("flow not detected after 6000B")
+    }
+    if _, ok := ed.GetBlacklist().LookUp(0x00010001); !ok {
+        t.Errorf("detected flow is not blacklisted")
+    }
+    //later packets are reported but not counted
+    for i := 0; i < 10; i++ {
+        if !ed.Detect(0x00010001, 1000, 0) {
+            t.Errorf("blacklisted flow not reported")
+        }
+    }
+    if c := ed.counters[1].count; c != 6000 {
+        t.Errorf("count is %d, packets of blacklisted flows should not be counted", c)
+    }
+    if ed.Detect(0x00020002, 1000, 0) {
+        t.Errorf("other flow detected")
+    }
+}
+
 func TestOverflow(t *testing.T) {
     num := maxuint32
     num++
@@ -488,6 +1075,15 @@ func BenchmarkProcessPktInsertBasic(b *testing.B) {
     }
 }
 
+func BenchmarkProcessPktManyCounters(b *testing.B) {
+    ed := NewEardetDtctr(1 << 14, 1500, 15000, 0)
+    rSlice := makeRandomInput(b.N)
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        resGlob = ed.processPkt(rSlice[i][0], rSlice[i][1])
+    }
+}
+
 func BenchmarkDetectInsertBasic(b *testing.B) {
     alpha_test := uint32(500)
     beta_th_test := uint32(5000)
@@ -7,6 +7,10 @@ import (
     "encoding/json"
     "io/ioutil"
     "encoding/binary"
+    "encoding/hex"
+    "math/bits"
+    "math/rand"
+    "sort"
 
     "github.com/hosslen/lfd/baseline"
     "github.com/hosslen/lfd/slidingwindow"
@@ -46,20 +50,96 @@ type Config struct {
         PcapFile string `json:"pcap_file"`
         TimeFile string `json:"time_file"`
         TxtTraceFile string `json:"txt_trace_file"`
+        BinaryTraceFile string `json:"binary_trace_file"`
+        FlowFile string `json:"flow_file"`
+        FlowSpreading string `json:"flow_spreading"`
+        BPFFilter string `json:"bpf_filter"`
     } `json:"traffic_config"`
     EARDetConfig struct {
         GammaLow int `json:"gamma_low"`
         GammaHigh int `json:"gamma_high"`
         BetaLow int `json:"beta_low"`
+        //if set, the number of counters is chosen so that flows at
+        //gamma_high are detected within this many seconds
+        MaxIncubationTime float64 `json:"max_incubation_time"`
+        //"legacy" (default) or "keyed"
+        BucketHash string `json:"bucket_hash"`
+        //hex encoded 16 byte key of the keyed hash, random if empty
+        BucketHashKey string `json:"bucket_hash_key"`
+        //candidate buckets per flow, default 2
+        Ways int `json:"ways"`
+        //maximum number of flows moved to insert a new one, default 1;
+        //0 disables displacement
+        DisplacementChain *int `json:"displacement_chain"`
+        //trace times (seconds since the first packet) at which the EARDet
+        //counters are printed
+        SnapshotTimes []float64 `json:"snapshot_times"`
+        //number of flows printed per snapshot, default 10
+        TopK int `json:"top_k"`
+        //empty the counter of a flow once EARDet detects it
+        RemoveOnDetect bool `json:"remove_on_detect"`
     } `json:"eardet_config"`
     RLFDConfig struct {
         Gamma int `json:"gamma"`
         Beta int `json:"beta"`
         TlFactor float64 `json:"t_l_factor"`
+        //if set, level l of the single RLFD, the ensemble and the RLFDs
+        //of Twin-RLFD lasts level_t_l_factors[l]*beta/gamma (one factor
+        //per level), stretched by the ratio of the RLFD's t_l to
+        //t_l_factor*beta/gamma, so the second RLFD of Twin-RLFD keeps
+        //its longer levels
+        LevelTlFactors []float64 `json:"level_t_l_factors"`
+        //counters per virtual counter node (a power of two), default 128
+        Fanout uint32 `json:"fanout"`
+        //depth of the virtual counter tree, default 4
+        Depth uint32 `json:"depth"`
+        //select the paths of the flows with a secret key, new each round
+        Rekey bool `json:"rekey"`
+        //candidate counters per flow on the lowest level, default 2
+        BottomSlots int `json:"bottom_slots"`
+        //maximum number of flows moved to insert a new one on the lowest
+        //level, default 1; 0 disables displacement
+        DisplacementChain *int `json:"displacement_chain"`
+        //flows without counter kept on the lowest level, default 0
+        StashSize int `json:"stash_size"`
+        //if set, an ensemble of this many RLFD instances with their own
+        //keys is evaluated as well
+        EnsembleSize int `json:"ensemble_size"`
+        //shift the rounds of the ensemble instances against each other
+        EnsembleStagger bool `json:"ensemble_stagger"`
+        //print every level of the single RLFD: its subtree, the largest
+        //counter and the flows on the lowest level
+        Trace bool `json:"trace"`
+        //if set, RLFD with and without rekeying is also evaluated against
+        //this many attack flows that hide behind a subtree of decoy flows
+        AdversarialFlows int `json:"adversarial_flows"`
+        //rate of the attack flows as a multiple of gamma, default 3
+        AdversarialRateFactor float64 `json:"adversarial_rate_factor"`
+        //length of the adversarial evaluation in rounds, default 100
+        AdversarialRounds int `json:"adversarial_rounds"`
     } `json:"RLFD_config"`
     CLEFConfig struct {
+        //rate of the flows the second RLFD of CLEF must catch, as a
+        //multiple of gamma, default 2
         AttackerFlowFactor float64 `json:"attacker_flow_factor"`
         MaxWatchlistSize uint32 `json:"max_watchlist_size"`
+        //what to do with a flagged flow if the watchlist is full: reject
+        //(block it, default), oldest or lowest (evict the flow inserted
+        //first or with the lowest bucket)
+        WatchlistEviction string `json:"watchlist_eviction"`
+        //how the subdetectors run: concurrent (default), sync or batched
+        ExecutionMode string `json:"execution_mode"`
+        //packets per batch in the batched mode, default 64
+        BatchSize int `json:"batch_size"`
+        //the subdetectors of CLEF out of eardet, rlfd1 and rlfd2 (the
+        //two RLFDs of Twin-RLFD), twin (Twin-RLFD as one subdetector),
+        //rlfd and ensemble (configured as in RLFD_config, an ensemble
+        //has 4 instances if ensemble_size is not set). Default eardet,
+        //rlfd1, rlfd2
+        Subdetectors []string `json:"subdetectors"`
+        //how many subdetectors must flag a flow before it is watched,
+        //default 1
+        Quorum int `json:"quorum"`
     } `json:"CLEF_config"`
 }
 
@@ -75,6 +155,49 @@ func getConfig(jsonFilePath string) Config {
     return config
 }
 
+//applies the bucket hashing settings of the config to an EARDet instance,
+//every instance gets its own random key unless a key is configured
+func setBucketHashing(ed *eardet.EardetDtctr, config Config) {
+    edConfig := config.EARDetConfig
+    ways := edConfig.Ways
+    if ways == 0 {
+        ways = 2
+    }
+    chain := 1
+    if edConfig.DisplacementChain != nil {
+        chain = *edConfig.DisplacementChain
+    }
+
+    var hasher eardet.BucketHasher
+    switch edConfig.BucketHash {
+    case "", "legacy":
+        hasher = eardet.LegacyHasher{}
+    case "keyed":
+        var key []byte
+        if edConfig.BucketHashKey != "" {
+            var err error
+            key, err = hex.DecodeString(edConfig.BucketHashKey)
+            if err != nil {
+                fmt.Printf("Invalid bucket_hash_key: %v\n", err)
+                os.Exit(1)
+            }
+        }
+        kh, err := eardet.NewKeyedHasher(key)
+        if err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+        hasher = kh
+    default:
+        fmt.Printf("Unknown bucket_hash %q\n", edConfig.BucketHash)
+        os.Exit(1)
+    }
+    if err := ed.SetBucketHashing(hasher, ways, chain); err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+}
+
 func main() {
 
     if len(os.Args) < 2 {
@@ -100,6 +223,9 @@ func main() {
     pcapFilename := config.TrafficConfig.PcapFile
     timesFilename := config.TrafficConfig.TimeFile
     txtTraceFilename := config.TrafficConfig.TxtTraceFile
+    binTraceFilename := config.TrafficConfig.BinaryTraceFile
+    flowFilename := config.TrafficConfig.FlowFile
+    bpfFilter := config.TrafficConfig.BPFFilter
 
     // link capacity 10Gbps = 1.25B/ns
     p := float64(config.TrafficConfig.LinkCapacity) / NANO_SEC_PER_SEC
@@ -126,31 +252,238 @@ func main() {
     rd_t_l := time.Duration(beta/gamma * config.RLFDConfig.TlFactor)
     rd_gamma := float64(config.RLFDConfig.Gamma) / NANO_SEC_PER_SEC
     rd_beta := uint32(config.RLFDConfig.Beta)
+    rd_m := config.RLFDConfig.Fanout
+    if rd_m == 0 {
+        rd_m = rlfd.DefaultFanout
+    }
+    rd_d := config.RLFDConfig.Depth
+    if rd_d == 0 {
+        rd_d = rlfd.DefaultDepth
+    }
 
     var trace *caida.TraceData
     if pcapFilename != "" && timesFilename != "" {
-        trace = caida.LoadPCAPFile(pcapFilename, timesFilename, maxPktNum)
+        trace = caida.LoadFilteredPCAPFile(
+            pcapFilename, timesFilename, bpfFilter, maxPktNum)
+    } else if pcapFilename != "" {
+        // without a times file, pcap_file names a directory or glob
+        // pattern of pcap/times file pairs
+        trace = caida.LoadPCAPDataset(pcapFilename, bpfFilter, maxPktNum)
     } else if txtTraceFilename != "" {
         trace = caida.LoadTxtTraceFile(txtTraceFilename, maxPktNum)
+    } else if binTraceFilename != "" {
+        trace = caida.LoadBinaryTraceFile(binTraceFilename, maxPktNum)
+    } else if flowFilename != "" {
+        model, err := caida.ParseSpreadingModel(
+            config.TrafficConfig.FlowSpreading)
+        if err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+        trace = caida.LoadFlowFile(flowFilename, model, maxPktNum)
     } else {
-        fmt.Println("Please provide a trace file either in pcap or txt")
+        fmt.Println("Please provide a trace file in pcap, txt, binary or " +
+            "flow record format (optionally gzip or bzip2 compressed)")
+        os.Exit(1)
+    }
+    if len(trace.Packets) == 0 {
+        fmt.Println("The trace contains no packets")
         os.Exit(1)
     }
 
     //initialize detectors
-    ed := eardet.NewConfigedEardetDtctr(
-        ed_counter_num, alpha, ed_beta_l, ed_gamma_l, p)
-    ed1 := eardet.NewConfigedEardetDtctr(
-        ed_counter_num, alpha, ed_beta_l, ed_gamma_l, p)
-    // TODO(hao): RLFD's setting could be wrong
-    rd := rlfd.NewRlfdDtctr(rd_beta, rd_gamma, rd_t_l)
+    var ed, ed1 *eardet.EardetDtctr
+    if config.EARDetConfig.MaxIncubationTime > 0 {
+        maxIncubation := time.Duration(
+            config.EARDetConfig.MaxIncubationTime * NANO_SEC_PER_SEC)
+        var g *eardet.EardetGuarantees
+        var err error
+        ed, g, err = eardet.NewTargetedEardetDtctr(
+            alpha, ed_beta_l, ed_gamma_l, ed_gamma_h, p, maxIncubation)
+        if err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+        ed1, _, err = eardet.NewTargetedEardetDtctr(
+            alpha, ed_beta_l, ed_gamma_l, ed_gamma_h, p, maxIncubation)
+        if err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+        fmt.Printf("EARDet with %d counters: flows at %fB/ns are detected " +
+            "within %v, flows below %fB/ns, %dB are never detected\n",
+            g.NumCounters, g.HighRate, g.Incubation, g.Gamma_l, g.Beta_l)
+    } else {
+        var err error
+        ed, err = eardet.NewConfigedEardetDtctr(
+            ed_counter_num, alpha, ed_beta_l, ed_gamma_l, p)
+        if err == nil {
+            ed1, err = eardet.NewConfigedEardetDtctr(
+                ed_counter_num, alpha, ed_beta_l, ed_gamma_l, p)
+        }
+        if err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+    }
+    setBucketHashing(ed, config)
+    setBucketHashing(ed1, config)
+    ed.SetRemoveOnDetect(config.EARDetConfig.RemoveOnDetect)
+    ed1.SetRemoveOnDetect(config.EARDetConfig.RemoveOnDetect)
+    rd, err := rlfd.NewRlfdDtctr(rd_beta, rd_gamma, rd_t_l, rd_m, rd_d)
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
     // Twin-RLFD with T_c(2) set according to Theorem 5.6 in CLEF paper
-    rd1 := rlfd.NewRlfdDtctr(rd_beta, rd_gamma, rd_t_l)
-    rd2_t_l := time.Duration((2*float64(rd.GetDepth())*ed_gamma_h)/(config.CLEFConfig.AttackerFlowFactor*rd_gamma))*rd_t_l
-    rd2 := rlfd.NewRlfdDtctr(rd_beta, rd_gamma, rd2_t_l)
-
+    attackerFactor := config.CLEFConfig.AttackerFlowFactor
+    if attackerFactor == 0 {
+        attackerFactor = 2
+    }
+    twin, err := rlfd.NewTwinRlfdDtctr(rd_beta, rd_gamma,
+        config.RLFDConfig.TlFactor, ed_gamma_h, attackerFactor, rd_m, rd_d)
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+    var rd_schedule []time.Duration
+    for _, factor := range config.RLFDConfig.LevelTlFactors {
+        rd_schedule = append(rd_schedule, time.Duration(beta/gamma * factor))
+    }
+    rd_slots := config.RLFDConfig.BottomSlots
+    if rd_slots == 0 {
+        rd_slots = 2
+    }
+    rd_chain := 1
+    if config.RLFDConfig.DisplacementChain != nil {
+        rd_chain = *config.RLFDConfig.DisplacementChain
+    }
+    rd_stash := config.RLFDConfig.StashSize
+    // schedule, lowest level and rekeying as set in RLFD_config, the
+    // schedule is stretched for RLFDs with longer levels
+    configureRlfd := func(r *rlfd.RlfdDtctr) error {
+        if rd_schedule != nil {
+            stretch := float64(r.GetT_l())/float64(rd_t_l)
+            schedule := make([]time.Duration, len(rd_schedule))
+            for l, dur := range rd_schedule {
+                schedule[l] = time.Duration(float64(dur)*stretch)
+            }
+            if err := r.SetSchedule(schedule); err != nil {
+                return err
+            }
+        }
+        if err := r.SetBottomLevel(rd_slots, rd_chain, rd_stash); err != nil {
+            return err
+        }
+        if config.RLFDConfig.Rekey {
+            return r.SetRekeying(nil)
+        }
+        return nil
+    }
+    for _, r := range []*rlfd.RlfdDtctr{rd, twin.GetRlfd1(), twin.GetRlfd2()} {
+        if err := configureRlfd(r); err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+    }
+    newEnsemble := func(k int) (*rlfd.EnsembleDtctr, error) {
+        en, err := rlfd.NewEnsembleDtctr(k, rd_beta, rd_gamma, rd_t_l, rd_m, rd_d,
+            config.RLFDConfig.EnsembleStagger)
+        if err == nil && rd_schedule != nil {
+            err = en.SetSchedule(rd_schedule)
+        }
+        if err == nil {
+            err = en.SetBottomLevel(rd_slots, rd_chain, rd_stash)
+        }
+        return en, err
+    }
+    var re *rlfd.EnsembleDtctr
+    if config.RLFDConfig.EnsembleSize > 0 {
+        re, err = newEnsemble(config.RLFDConfig.EnsembleSize)
+        if err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+    }
+    if config.RLFDConfig.Trace {
+        start := trace.Packets[0].Duration
+        rd.SetTraceHook(func(lt *rlfd.LevelTrace) {
+            printRlfdLevel(lt, start)
+        })
+    }
     cdBlackList := cuckoo.NewCuckoo()
-    cd := clef.NewClefDtctr(ed1, rd1, rd2, float64(rd_gamma), float64(rd_beta), config.CLEFConfig.MaxWatchlistSize, cdBlackList)
+    // CLEF's own instances of the subdetectors, each may be used once
+    cdNames := config.CLEFConfig.Subdetectors
+    if cdNames == nil {
+        cdNames = []string{"eardet", "rlfd1", "rlfd2"}
+    }
+    var cdSubdetectors []clef.Subdetector
+    used := make(map[string]bool)
+    for _, name := range cdNames {
+        var sd clef.Subdetector
+        switch name {
+        case "eardet":
+            sd = ed1
+        case "twin":
+            sd = twin
+        case "rlfd1":
+            sd = twin.GetRlfd1()
+        case "rlfd2":
+            sd = twin.GetRlfd2()
+        case "rlfd":
+            var r *rlfd.RlfdDtctr
+            r, err = rlfd.NewRlfdDtctr(rd_beta, rd_gamma, rd_t_l, rd_m, rd_d)
+            if err == nil {
+                err = configureRlfd(r)
+            }
+            sd = r
+        case "ensemble":
+            k := config.RLFDConfig.EnsembleSize
+            if k == 0 {
+                k = 4
+            }
+            sd, err = newEnsemble(k)
+        default:
+            err = fmt.Errorf("unknown CLEF subdetector %q", name)
+        }
+        if err == nil && (used[name] || used["twin"] && (name == "rlfd1" || name == "rlfd2") ||
+                name == "twin" && (used["rlfd1"] || used["rlfd2"])) {
+            err = fmt.Errorf("CLEF subdetector %q is used twice", name)
+        }
+        if err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+        used[name] = true
+        cdSubdetectors = append(cdSubdetectors, sd)
+    }
+    cd, err := clef.NewCustomClefDtctr(cdSubdetectors, float64(rd_gamma),
+        float64(rd_beta), config.CLEFConfig.MaxWatchlistSize,
+        twin.GetRlfd1().GetT_l(), cdBlackList)
+    if err == nil && config.CLEFConfig.Quorum > 0 {
+        err = cd.SetQuorum(config.CLEFConfig.Quorum)
+    }
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+    eviction, err := clef.ParseEvictionPolicy(config.CLEFConfig.WatchlistEviction)
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+    cd.SetEvictionPolicy(eviction)
+    mode, err := clef.ParseExecutionMode(config.CLEFConfig.ExecutionMode)
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+    cd.SetExecutionMode(mode)
+    defer cd.Close()
+    batchSize := config.CLEFConfig.BatchSize
+    if batchSize <= 0 {
+        batchSize = 64
+    }
     //cd.SetCurrentTime(time.Now().Sub(time.Time{}))
 
     bdBlackList := cuckoo.NewCuckoo()
@@ -161,6 +494,9 @@ func main() {
 
     ed.SetCurrentTime(trace.Packets[0].Duration)
     rd.SetCurrentTime(trace.Packets[0].Duration)
+    if re != nil {
+        re.SetCurrentTime(trace.Packets[0].Duration)
+    }
 
     fmt.Printf("\n-----------------------------------\n")
     fmt.Printf("\n=========Accuracy Tests============\n")
@@ -172,10 +508,27 @@ func main() {
             "\tpcapFilename=%s\n" +
             "\ttimesFilename=%s\n",
         pcapFilename, timesFilename)
+    if bpfFilter != "" {
+        fmt.Printf("BPF filter: %q (%d packets removed)\n",
+            bpfFilter, trace.FilteredCounter)
+    }
     fmt.Printf("Link capacity: p=%fB/ns\n", p)
     fmt.Printf("Flow spec: gamma=%f, beta=%f\n", gamma, beta)
 
-    evaluateDetectorAccuracy(bd, ed, rd, cd, sd, trace) 
+    var snapshotTimes []time.Duration
+    for _, secs := range config.EARDetConfig.SnapshotTimes {
+        snapshotTimes = append(snapshotTimes,
+            time.Duration(secs*NANO_SEC_PER_SEC))
+    }
+    sort.Slice(snapshotTimes, func(i, j int) bool {
+        return snapshotTimes[i] < snapshotTimes[j]
+    })
+    topK := config.EARDetConfig.TopK
+    if topK == 0 {
+        topK = 10
+    }
+
+    evaluateDetectorAccuracy(bd, ed, rd, re, cd, cdNames, sd, trace, snapshotTimes, topK)
       
 
     fmt.Printf("\n--------------------------------------\n")
@@ -186,21 +539,211 @@ func main() {
         evaluateDetectorPerformance(bd, BASELINE_CONFIG_ID, trace)
     }
     if (evalMap[CLEF_CONFIG_ID]) {
-        evaluateDetectorPerformance(cd, CLEF_CONFIG_ID, trace)
+        if mode == clef.Batched {
+            evaluateClefBatchPerformance(cd, batchSize, trace)
+        } else {
+            evaluateDetectorPerformance(cd, CLEF_CONFIG_ID, trace)
+        }
     }
     if (evalMap[EARDet_CONFIG_ID]) {
         evaluateDetectorPerformance(ed, EARDet_CONFIG_ID, trace)
     }
     if (evalMap[RLFD_CONFIG_ID]) {
         evaluateDetectorPerformance(rd, RLFD_CONFIG_ID, trace)
+        if re != nil {
+            evaluateDetectorPerformance(re, "Ensemble RLFD", trace)
+        }
+    }
+
+    if config.RLFDConfig.AdversarialFlows > 0 {
+        factor := config.RLFDConfig.AdversarialRateFactor
+        if factor == 0 {
+            factor = 3
+        }
+        rounds := config.RLFDConfig.AdversarialRounds
+        if rounds == 0 {
+            rounds = 100
+        }
+        evaluateRlfdAdversarial(rd_beta, rd_gamma, rd_t_l, rd_m, rd_d, alpha,
+            config.RLFDConfig.AdversarialFlows, factor, rounds)
+    }
+
+}
+
+
+//prints what RLFD saw on a level, start is the time of the first packet
+func printRlfdLevel(lt *rlfd.LevelTrace, start time.Duration) {
+    fmt.Printf("RLFD round %d level %d at %v: path 0x%08x", lt.Round,
+        lt.Level, lt.Start - start, lt.Path)
+    if !lt.Lowest {
+        fmt.Printf(", max counter %d (%dB)\n", lt.MaxIndex, lt.MaxCount)
+        return
+    }
+    fmt.Printf(", %d flows on the lowest level\n", len(lt.Flows))
+    for _, f := range lt.Flows {
+        fmt.Printf("\tflow %10d: %dB\n", f.FlowID, f.Count)
+    }
+}
+
+//a flow of the adversarial evaluation
+type adversarialFlow struct {
+    id uint32
+    attack bool
+    //time between two packets
+    interval time.Duration
+}
+
+//The attacker knows that RLFD follows the heaviest subtree and selects the
+//paths by flow ID bits. It runs a few legitimate decoy flows (at gamma/2)
+//that share all subtrees down to the lowest level and together outweigh
+//every other top level subtree. The attack flows sit in the other top level
+//subtrees and are never looked at. Compares RLFD with and without rekeying
+//on this traffic.
+func evaluateRlfdAdversarial(beta uint32, gamma float64, t_l time.Duration,
+        m uint32, d uint32, pktSize uint32, numAttack int, factor float64,
+        rounds int) {
+    r := rand.New(rand.NewSource(1))
+    s := uint32(bits.TrailingZeros32(m))
+    bottomShift := 32 - s*d
+
+    //the attack flows spread over the top level subtrees 1..m-1, the
+    //decoys fill subtree 0 down to the lowest level
+    attackRate := factor*gamma
+    perSubtree := (numAttack + int(m) - 2)/int(m - 1)
+    numDecoys := int(2*attackRate*float64(perSubtree)/gamma) + 1
+    if numDecoys > int(m) {
+        fmt.Printf("Need %d decoys, but the lowest level has only %d counters\n",
+            numDecoys, m)
+        numDecoys = int(m)
+    }
+    var flows []adversarialFlow
+    for i := 0; i < numAttack; i++ {
+        top := uint32(1 + i%int(m - 1)) << (32 - s)
+        id := top | r.Uint32() >> s
+        flows = append(flows, adversarialFlow{id, true,
+            time.Duration(float64(pktSize)/attackRate)})
+    }
+    for i := 0; i < numDecoys; i++ {
+        flows = append(flows, adversarialFlow{uint32(i) << bottomShift, false,
+            time.Duration(float64(pktSize)/(gamma/2))})
+    }
+
+    //all packets of the evaluation, every flow starts at a random offset
+    duration := time.Duration(rounds)*time.Duration(d)*t_l
+    type adversarialPkt struct {
+        flow int
+        t time.Duration
+    }
+    var pkts []adversarialPkt
+    for i, f := range flows {
+        for t := time.Duration(r.Int63n(int64(f.interval))); t < duration; t += f.interval {
+            pkts = append(pkts, adversarialPkt{i, t})
+        }
+    }
+    sort.Slice(pkts, func(i, j int) bool {
+        return pkts[i].t < pkts[j].t
+    })
+
+    fmt.Printf("\n========RLFD under attack========\n")
+    fmt.Printf("%d attack flows at %fB/ns, %d decoy flows at %fB/ns, " +
+        "%d rounds (%v), %d packets\n", numAttack, attackRate, numDecoys,
+        gamma/2, rounds, duration, len(pkts))
+
+    for _, rekey := range []bool{false, true} {
+        rd, err := rlfd.NewRlfdDtctr(beta, gamma, t_l, m, d)
+        if err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+        if rekey {
+            if err := rd.SetRekeying(nil); err != nil {
+                fmt.Println(err)
+                os.Exit(1)
+            }
+        }
+        detectedAt := make(map[int]time.Duration)
+        for _, pkt := range pkts {
+            if _, ok := detectedAt[pkt.flow]; ok {
+                continue
+            }
+            if rd.Detect(flows[pkt.flow].id, pktSize, pkt.t) {
+                detectedAt[pkt.flow] = pkt.t
+            }
+        }
+
+        attacks, decoys := 0, 0
+        var delay time.Duration
+        for i, t := range detectedAt {
+            if flows[i].attack {
+                attacks++
+                delay += t
+            } else {
+                decoys++
+            }
+        }
+        fmt.Printf("Rekeying %t: detected %d of %d attack flows", rekey,
+            attacks, numAttack)
+        if attacks > 0 {
+            fmt.Printf(" (after %v on average)", delay/time.Duration(attacks))
+        }
+        fmt.Printf(", %d decoy flows\n", decoys)
     }
+}
+
 
+//records the first detection of a flow
+func noteDetection(detected map[uint32]time.Duration, flowID uint32, t time.Duration) {
+    if _, ok := detected[flowID]; !ok {
+        detected[flowID] = t
+    }
 }
 
+//prints how much later than the baseline a detector caught the flows both
+//detected
+func printDetectionDelay(base, detected map[uint32]time.Duration) {
+    var total, max time.Duration
+    n := 0
+    for flowID, t := range detected {
+        if tb, ok := base[flowID]; ok {
+            delay := t - tb
+            total += delay
+            if delay > max {
+                max = delay
+            }
+            n++
+        }
+    }
+    if n == 0 {
+        fmt.Printf("Detection delay: no true positives\n")
+        return
+    }
+    fmt.Printf("Detection delay: avg %v, max %v over %d flows\n",
+        total/time.Duration(n), max, n)
+}
+
+//prints the state of the EARDet counters and the topK flows
+func printEardetSnapshot(snap *eardet.Snapshot, at time.Duration, topK int) {
+    virtual := 0
+    for _, c := range snap.Counters {
+        if c.Virtual {
+            virtual++
+        }
+    }
+    fmt.Printf("\n========EARDet snapshot at %v========\n", at)
+    fmt.Printf("floor=%d, threshold=%d (+%d), maxValue=%d\n", snap.Floor,
+        snap.Threshold, snap.Threshold - snap.Floor, snap.MaxValue)
+    fmt.Printf("Non-empty counters: %d (%d virtual)\n",
+        len(snap.Counters), virtual)
+    for i, c := range snap.TopK(topK) {
+        fmt.Printf("%3d. flow %10d: %dB\n", i + 1, c.FlowID, c.Count)
+    }
+}
 
 func evaluateDetectorAccuracy(bd *baseline.BaselineDtctr, ed *eardet.EardetDtctr,
-                              rd *rlfd.RlfdDtctr, cd *clef.ClefDtctr,
-                              sd *slidingwindow.SlidingWindowDtctr, trace *caida.TraceData) {
+                              rd *rlfd.RlfdDtctr, re *rlfd.EnsembleDtctr,
+                              cd *clef.ClefDtctr, cdNames []string,
+                              sd *slidingwindow.SlidingWindowDtctr, trace *caida.TraceData,
+                              snapshotTimes []time.Duration, topK int) {
 
     //FP and FN
     edFP := 0
@@ -209,6 +752,8 @@ func evaluateDetectorAccuracy(bd *baseline.BaselineDtctr, ed *eardet.EardetDtctr
     rdFN := 0
     cdFP := 0
     cdFN := 0
+    reFP := 0
+    reFN := 0
 
     //damage metric
     edOveruseDamage := uint32(0)
@@ -217,6 +762,8 @@ func evaluateDetectorAccuracy(bd *baseline.BaselineDtctr, ed *eardet.EardetDtctr
     rdFPDamage := uint32(0)
     cdOveruseDamage := uint32(0)
     cdFPDamage := uint32(0)
+    reOveruseDamage := uint32(0)
+    reFPDamage := uint32(0)
 
     //blacklists
     blackListED := make(map[uint32]int)
@@ -224,6 +771,16 @@ func evaluateDetectorAccuracy(bd *baseline.BaselineDtctr, ed *eardet.EardetDtctr
     blackListCD := make(map[uint32]int)
     blackListBD := make(map[uint32]int)
     blackListSD := make(map[uint32]int)
+    blackListRE := make(map[uint32]int)
+    //flows that CLEF put on its watchlist
+    watchedCD := make(map[uint32]bool)
+
+    //time of the first detection of every flow
+    detectedBD := make(map[uint32]time.Duration)
+    detectedED := make(map[uint32]time.Duration)
+    detectedRD := make(map[uint32]time.Duration)
+    detectedRE := make(map[uint32]time.Duration)
+    detectedCD := make(map[uint32]time.Duration)
 
     // Initialize hash function
     aesh := aeshash.NewAESHasher([]byte("ABCDEFGHIJKLMNOP"))
@@ -231,12 +788,19 @@ func evaluateDetectorAccuracy(bd *baseline.BaselineDtctr, ed *eardet.EardetDtctr
 
     var flowID uint32
     var pkt *caida.CaidaPkt
-    var resED, resRD, resBD, resCD, resSD bool
+    var resED, resRD, resBD, resCD, resSD, resRE bool
 
     // traverse packets in the trace
     for i := 0; i < len(trace.Packets); i++ {
         pkt = trace.Packets[i]
         flowID = aesh.Hash_uint32(&pkt.Id)
+
+        // EARDet snapshots due before this packet
+        for len(snapshotTimes) > 0 &&
+                pkt.Duration - trace.Packets[0].Duration >= snapshotTimes[0] {
+            printEardetSnapshot(ed.Snapshot(), snapshotTimes[0], topK)
+            snapshotTimes = snapshotTimes[1:]
+        }
         
         // passing packet to EARDet
         if _, ok := blackListED[flowID]; !ok {
@@ -252,9 +816,21 @@ func evaluateDetectorAccuracy(bd *baseline.BaselineDtctr, ed *eardet.EardetDtctr
             resRD = true
         }
 
+        // passing packet to the RLFD ensemble
+        if re == nil {
+            resRE = false
+        } else if _, ok := blackListRE[flowID]; !ok {
+            resRE = re.Detect(flowID, pkt.Size, pkt.Duration)
+        } else {
+            resRE = true
+        }
+
         // passing packet to CLEF
         if _, ok := blackListCD[flowID]; !ok {
             resCD = cd.Detect(flowID, pkt.Size, pkt.Duration)
+            if cd.IsWatched(flowID) {
+                watchedCD[flowID] = true
+            }
         } else {
             resCD = true
         }
@@ -272,22 +848,32 @@ func evaluateDetectorAccuracy(bd *baseline.BaselineDtctr, ed *eardet.EardetDtctr
         if resCD {blackListCD[flowID]++}
         if resBD {blackListBD[flowID]++}
         if resSD {blackListSD[flowID]++}
+        if resRE {blackListRE[flowID]++}
+
+        if resBD {noteDetection(detectedBD, flowID, pkt.Duration)}
+        if resED {noteDetection(detectedED, flowID, pkt.Duration)}
+        if resRD {noteDetection(detectedRD, flowID, pkt.Duration)}
+        if resRE {noteDetection(detectedRE, flowID, pkt.Duration)}
+        if resCD {noteDetection(detectedCD, flowID, pkt.Duration)}
 
         //damage metric
         if resBD {
             if !resED {edOveruseDamage += pkt.Size}
             if !resRD {rdOveruseDamage += pkt.Size}
             if !resCD {cdOveruseDamage += pkt.Size}
+            if !resRE {reOveruseDamage += pkt.Size}
         } else {
             if resED {edFPDamage += pkt.Size}
             if resRD {rdFPDamage += pkt.Size}
             if resCD {cdFPDamage += pkt.Size}
+            if resRE {reFPDamage += pkt.Size}
         }
     }
 
     edTotalDamage := edFPDamage + edOveruseDamage
     rdTotalDamage := rdFPDamage + rdOveruseDamage
     cdTotalDamage := cdFPDamage + cdOveruseDamage
+    reTotalDamage := reFPDamage + reOveruseDamage
 
 
     //compare blacklists
@@ -307,6 +893,11 @@ func evaluateDetectorAccuracy(bd *baseline.BaselineDtctr, ed *eardet.EardetDtctr
             cdFP++
         } 
     }
+    for k, _ := range blackListRE {
+        if _, ok := blackListBD[k]; !ok {
+            reFP++
+        }
+    }
 
     // FNs
     for k, _ := range blackListBD {
@@ -319,6 +910,9 @@ func evaluateDetectorAccuracy(bd *baseline.BaselineDtctr, ed *eardet.EardetDtctr
         if _, ok := blackListCD[k]; !ok {
             cdFN++
         }
+        if _, ok := blackListRE[k]; !ok {
+            reFN++
+        }
     }
 
 
@@ -329,6 +923,11 @@ func evaluateDetectorAccuracy(bd *baseline.BaselineDtctr, ed *eardet.EardetDtctr
     fmt.Printf("Number of flows: %d\n", sd.NumFlows)
     fmt.Printf("Number of flows detected by baseline: %d\n", len(blackListBD))
 
+    for _, st := range snapshotTimes {
+        fmt.Printf("\nNo EARDet snapshot at %v: the trace ends at %v\n", st,
+            pkt.Duration - trace.Packets[0].Duration)
+    }
+
     fmt.Printf("\n========EARDet========\n")
     fmt.Printf(
         "Config: alpha=%d, gamma_l=%f, beta_l=%d, " +
@@ -342,12 +941,17 @@ func evaluateDetectorAccuracy(bd *baseline.BaselineDtctr, ed *eardet.EardetDtctr
                 len(blackListED)-edFP)
     fmt.Printf("overuseDamage: %dB, falsePositiveDamage: %dB, total: %dB (%.2f%%)\n",
         edOveruseDamage, edFPDamage, edTotalDamage, float64(edTotalDamage)/float64(cdTotalDamage)*100)
+    printDetectionDelay(detectedBD, detectedED)
     
     fmt.Printf("\n========Single RLFD========\n")
     fmt.Printf("Config: t_l=%dns, th=%d, depth=%d, fanout=%d, " +
                 "gamma=%fB/ns, beta=%dB\n",
         rd.GetT_l().Nanoseconds(), rd.GetTh(), rd.GetDepth(),
         rd.GetNumCountersPerNode(), rd.GetGamma(), rd.GetBeta())
+    fmt.Printf("Schedule: %v, thresholds: %v\n", rd.GetSchedule(),
+        rd.GetThresholds())
+    fmt.Printf("Inserts dropped on the lowest level: %d\n",
+        rd.GetDroppedInserts())
     fmt.Printf("Number of flows: %d\n", sd.NumFlows)
     fmt.Printf("Number of flows detected by baseline: %d\n", len(blackListBD))
     fmt.Printf("Number of flows detected by RLFD: %d\n", len(blackListRD))
@@ -355,18 +959,56 @@ func evaluateDetectorAccuracy(bd *baseline.BaselineDtctr, ed *eardet.EardetDtctr
                 len(blackListRD)-rdFP)
     fmt.Printf("overuseDamage: %dB, falsePositiveDamage: %dB, total: %dB (%.2f%%)\n",
         rdOveruseDamage, rdFPDamage, rdTotalDamage, float64(rdTotalDamage)/float64(cdTotalDamage)*100)
+    printDetectionDelay(detectedBD, detectedRD)
+
+    if re != nil {
+        fmt.Printf("\n========Ensemble RLFD========\n")
+        fmt.Printf("Config: %d instances, depth=%d, fanout=%d\n", re.GetSize(),
+            rd.GetDepth(), rd.GetNumCountersPerNode())
+        fmt.Printf("Number of flows detected by baseline: %d\n", len(blackListBD))
+        fmt.Printf("Number of flows detected by the ensemble: %d\n", len(blackListRE))
+        fmt.Printf("FP (flows): %d FN (flows): %d, TP: %d\n", reFP, reFN,
+                    len(blackListRE)-reFP)
+        fmt.Printf("overuseDamage: %dB, falsePositiveDamage: %dB, total: %dB (%.2f%%)\n",
+            reOveruseDamage, reFPDamage, reTotalDamage, float64(reTotalDamage)/float64(cdTotalDamage)*100)
+        printDetectionDelay(detectedBD, detectedRE)
+        fmt.Printf("Detections per instance: %v\n", re.GetDetections())
+        fmt.Printf("Inserts dropped on the lowest level: %d\n",
+            re.GetDroppedInserts())
+    }
 
     fmt.Printf("\n========CLEF========\n")
     fmt.Printf("Number of flows: %d\n", sd.NumFlows)
     fmt.Printf("Number of flows detected by baseline: %d\n", len(blackListBD))
     fmt.Printf("Number of flows detected by CLEF: %d\n", len(blackListCD))
+    fmt.Printf("Execution mode: %v\n", cd.GetExecutionMode())
     fmt.Printf("Number of flows in CLEF watchlist: %d\n", cd.GetWatchlistSize())
     fmt.Printf("FP (flows): %d FN (flows): %d, TP: %d\n", cdFP, cdFN,
                 len(blackListCD)-cdFP)
     fmt.Printf("overuseDamage: %dB, falsePositiveDamage: %dB, total: %dB\n",
         cdOveruseDamage, cdFPDamage, cdTotalDamage)
-    fmt.Printf("Subdetector Blocking: EARDet: %d, RLFD 1: %d, RLFD 2: %d\n",
-                cd.EdBlocked, cd.Rd1Blocked, cd.Rd2Blocked)
+    printDetectionDelay(detectedBD, detectedCD)
+    fmt.Printf("Subdetector Flagging (quorum %d):", cd.GetQuorum())
+    for i, n := range cd.GetDetections() {
+        fmt.Printf(" %s: %d", cdNames[i], n)
+    }
+    fmt.Printf("\n")
+    // watched flows that are neither blocked nor large would have been FPs
+    // of the subdetectors
+    cdPrevented := 0
+    for flowID := range watchedCD {
+        _, blocked := blackListCD[flowID]
+        _, large := blackListBD[flowID]
+        if !blocked && !large {
+            cdPrevented++
+        }
+    }
+    fmt.Printf("Watchlist: watched: %d, blocked: %d, released: %d, full: %d\n",
+                len(watchedCD), cd.WatchlistBlocked, cd.WatchlistReleased,
+                cd.WatchlistFull)
+    fmt.Printf("Watchlist eviction: %v, evicted: %d\n", cd.GetEvictionPolicy(),
+                cd.WatchlistEvicted)
+    fmt.Printf("FPs prevented by the watchlist (flows): %d\n", cdPrevented)
 
 }
 
@@ -410,4 +1052,50 @@ func evaluateDetectorPerformance (dtctr Dtctr, dtctrName string, trace *caida.Tr
 
     fmt.Println("Detector", dtctrName, "took", consumedTime, "for", i, "packets")
 
-}
\ No newline at end of file
+}
+
+// Like evaluateDetectorPerformance, but hands CLEF batchSize packets at a
+// time. Flows detected within a batch are blacklisted for the next one.
+func evaluateClefBatchPerformance(cd *clef.ClefDtctr, batchSize int, trace *caida.TraceData) {
+
+    aesh := aeshash.NewAESHasher([]byte("ABCDEFGHIJKLMNOP"))
+
+    blackList := cd.GetBlacklist()
+    manuallyUpdateBlacklist := blackList == nil
+    if manuallyUpdateBlacklist {
+        blackList = cuckoo.NewCuckoo()
+    }
+
+    batch := make([]clef.Packet, 0, batchSize)
+    results := make([]bool, batchSize)
+    detect := func() {
+        cd.DetectBatch(batch, results)
+        for j := range batch {
+            if results[j] && manuallyUpdateBlacklist {
+                blackList.Insert(batch[j].FlowID, 0)
+            }
+        }
+        batch = batch[:0]
+    }
+
+    startTime := time.Now()
+    // traverse packets in the trace
+    var i int
+    for i = 0; i < len(trace.Packets); i++ {
+        pkt := trace.Packets[i]
+        flowID := aesh.Hash_uint32(&pkt.Id)
+
+        if _, ok := blackList.LookUp(flowID); !ok {
+            batch = append(batch, clef.Packet{FlowID: flowID, Size: pkt.Size, T: pkt.Duration})
+            if len(batch) == batchSize {
+                detect()
+            }
+        }
+    }
+    detect()
+    consumedTime := time.Now().Sub(startTime)
+
+    fmt.Println("Detector", CLEF_CONFIG_ID, "took", consumedTime, "for", i,
+        "packets in batches of", batchSize)
+
+}
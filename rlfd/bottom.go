@@ -0,0 +1,184 @@
+// This file contains the table of flows on the lowest RLFD level: the
+// candidate counters of a flow, the displacement of flows along cuckoo
+// chains and the stash for flows that find no counter.
+package rlfd
+
+import (
+    "fmt"
+)
+
+const (
+    //maximum number of candidate counters per flow on the lowest level
+    MaxSlots = 8
+)
+
+//a counter reached while searching for a displacement chain
+type chainNode struct {
+    index uint32
+    //node whose flow would move into index, -1 for the candidates of the
+    //new flow
+    parent int
+}
+
+// Configure the lowest level: every flow has slots candidate counters, to
+// make room for a new flow up to maxChain flows may be moved to one of
+// their other candidates, and flows that still find no counter are kept
+// in a stash of stashSize entries. Packets of flows beyond that are
+// dropped and counted, see GetDroppedInserts. The default is 2 slots,
+// chains of 1 and no stash.
+func (rd *RlfdDtctr) SetBottomLevel(slots int, maxChain int, stashSize int) error {
+    if slots < 1 || slots > MaxSlots {
+        return fmt.Errorf("RLFD slots per flow must be in [1, %d], not %d",
+            MaxSlots, slots)
+    }
+    if maxChain < 0 || stashSize < 0 {
+        return fmt.Errorf("RLFD displacement chain and stash must not be negative")
+    }
+    rd.candidates = make([]uint32, slots)
+    rd.alternatives = make([]uint32, slots)
+    rd.maxChain = maxChain
+    rd.stash = make([]counter, 0, stashSize)
+    return nil
+}
+
+//number of packets on the lowest level whose flow found neither a counter
+//nor room in the stash, so they were not counted
+func (rd *RlfdDtctr) GetDroppedInserts() uint64 {
+    return rd.droppedInserts
+}
+
+//writes the candidate counters of the path ID id on the lowest level to
+//buckets: the index of the level, the s bits above the lowest s bits,
+//then hashes of the path ID
+func (rd *RlfdDtctr) bottomCandidates(id uint32, buckets []uint32) {
+    buckets[0] = (id & rd.bitmaskIndex) >> rd.indexShift()
+    if len(buckets) > 1 {
+        buckets[1] = rd.altIndex(id)
+    }
+    for j := 2; j < len(buckets); j++ {
+        buckets[j] = fmix32(id + uint32(j)*0x9e3779b9) & (rd.m - 1)
+    }
+}
+
+//the alternative counter of a flow on the lowest level
+func (rd *RlfdDtctr) altIndex(flowID uint32) uint32 {
+    return (flowID >> rd.s) & (rd.m - 1)
+}
+
+//counts a packet on the lowest level, returns true if the flow is above
+//the threshold of the level
+func (rd *RlfdDtctr) countBottom(flowID uint32, id uint32, size uint32) bool {
+    rd.bottomCandidates(id, rd.candidates)
+    var c, free *counter
+    for _, i := range rd.candidates {
+        b := &rd.counters[i]
+        if b.reset != rd.reset {
+            if free == nil {
+                free = b
+            }
+        } else if b.flowID == flowID {
+            c = b
+            break
+        }
+    }
+    if c == nil {
+        for i := range rd.stash {
+            if rd.stash[i].flowID == flowID {
+                c = &rd.stash[i]
+                break
+            }
+        }
+    }
+
+    if c != nil {
+        c.count += size
+    } else {
+        if free == nil {
+            free = rd.displace()
+        }
+        if free != nil {
+            rd.numCountersReseted++
+        } else if len(rd.stash) < cap(rd.stash) {
+            rd.stash = rd.stash[:len(rd.stash) + 1]
+            free = &rd.stash[len(rd.stash) - 1]
+        } else {
+            rd.droppedInserts++
+            return false
+        }
+        c = free
+        c.count = size
+        c.flowID = flowID
+        c.pathID = id
+        c.reset = rd.reset
+    }
+
+    //check threshold
+    th := rd.thresholds[rd.level]
+    return size > th || c.count > th
+}
+
+//searches breadth-first for the shortest chain of at most maxChain moves
+//that frees a candidate counter and moves the flows along it. Returns
+//the freed counter, which still has to be filled, or nil. Candidates and
+//the other candidates of their flows are tried in order.
+func (rd *RlfdDtctr) displace() *counter {
+    if rd.maxChain == 0 {
+        return nil
+    }
+    rd.visitGen++
+    if rd.visitGen == 0 {
+        //wrapped around, forget all old marks
+        for i := range rd.visited {
+            rd.visited[i] = 0
+        }
+        rd.visitGen = 1
+    }
+    nodes := rd.chain[:0]
+    for _, i := range rd.candidates {
+        if rd.visited[i] != rd.visitGen {
+            rd.visited[i] = rd.visitGen
+            nodes = append(nodes, chainNode{i, -1})
+        }
+    }
+
+    last := -1
+    start, end := 0, len(nodes)
+    for depth := 0; depth < rd.maxChain && start < end && last < 0; depth++ {
+        for n := start; n < end && last < 0; n++ {
+            rd.bottomCandidates(rd.counters[nodes[n].index].pathID, rd.alternatives)
+            for _, i := range rd.alternatives {
+                if rd.visited[i] == rd.visitGen {
+                    continue
+                }
+                rd.visited[i] = rd.visitGen
+                nodes = append(nodes, chainNode{i, n})
+                if rd.counters[i].reset != rd.reset {
+                    last = len(nodes) - 1
+                    break
+                }
+            }
+        }
+        start, end = end, len(nodes)
+    }
+    rd.chain = nodes
+    if last < 0 {
+        return nil
+    }
+
+    n := last
+    for nodes[n].parent >= 0 {
+        rd.counters[nodes[n].index] = rd.counters[nodes[nodes[n].parent].index]
+        n = nodes[n].parent
+    }
+    return &rd.counters[nodes[n].index]
+}
+
+//the finalizer of MurmurHash3, mixes the bits of h
+func fmix32(h uint32) uint32 {
+    h ^= h >> 16
+    h *= 0x85ebca6b
+    h ^= h >> 13
+    h *= 0xc2b2ae35
+    h ^= h >> 16
+    return h
+}
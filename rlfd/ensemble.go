@@ -0,0 +1,138 @@
+// An ensemble of RLFD instances with independent keys
+package rlfd
+
+import (
+    "fmt"
+    "time"
+
+    "github.com/hosslen/lfd/cuckoo"
+)
+
+//runs k RLFD instances side by side, each with its own secret key, and
+//flags a flow as soon as one instance flags it. Every instance looks at a
+//different subtree per round, so k instances catch more large flows than
+//one at k times the memory.
+type EnsembleDtctr struct {
+    instances []*RlfdDtctr
+    //offset of the round phase of every instance
+    offsets []time.Duration
+    stagger bool
+    //the time set with SetCurrentTime
+    start time.Duration
+    //number of packets flagged by every instance
+    detections []uint64
+}
+
+//returns a pointer to a new ensemble of k RLFD instances, configured as
+//in NewRlfdDtctr. With stagger, the rounds of instance i are shifted by
+//i/k of a round against those of instance 0.
+func NewEnsembleDtctr(k int, beta uint32, gamma float64, t_l time.Duration,
+        m uint32, d uint32, stagger bool) (*EnsembleDtctr, error) {
+    if k < 1 {
+        return nil, fmt.Errorf("RLFD ensemble needs at least one instance, not %d", k)
+    }
+    en := &EnsembleDtctr{}
+    en.instances = make([]*RlfdDtctr, k)
+    en.offsets = make([]time.Duration, k)
+    en.detections = make([]uint64, k)
+    for i := range en.instances {
+        rd, err := NewRlfdDtctr(beta, gamma, t_l, m, d)
+        if err != nil {
+            return nil, err
+        }
+        if err := rd.SetRekeying(nil); err != nil {
+            return nil, err
+        }
+        en.instances[i] = rd
+    }
+    en.stagger = stagger
+    en.setOffsets()
+    return en, nil
+}
+
+//shifts the rounds of the instances against each other if stagger is set
+func (en *EnsembleDtctr) setOffsets() {
+    k := time.Duration(len(en.instances))
+    for i, rd := range en.instances {
+        if en.stagger {
+            en.offsets[i] = time.Duration(i)*rd.GetRoundDuration()/k
+        }
+    }
+    en.SetCurrentTime(en.start)
+}
+
+//sets the schedule of every instance, see RlfdDtctr.SetSchedule. Must be
+//called before the first packet.
+func (en *EnsembleDtctr) SetSchedule(schedule []time.Duration) error {
+    for _, rd := range en.instances {
+        if err := rd.SetSchedule(schedule); err != nil {
+            return err
+        }
+    }
+    en.setOffsets()
+    return nil
+}
+
+//configures the lowest level of every instance, see
+//RlfdDtctr.SetBottomLevel
+func (en *EnsembleDtctr) SetBottomLevel(slots int, maxChain int, stashSize int) error {
+    for _, rd := range en.instances {
+        if err := rd.SetBottomLevel(slots, maxChain, stashSize); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+//the inserts dropped on the lowest level by all instances
+func (en *EnsembleDtctr) GetDroppedInserts() uint64 {
+    dropped := uint64(0)
+    for _, rd := range en.instances {
+        dropped += rd.GetDroppedInserts()
+    }
+    return dropped
+}
+
+func (en *EnsembleDtctr) SetCurrentTime(t time.Duration) {
+    en.start = t
+    for i, rd := range en.instances {
+        //going back by the offset puts the instance ahead in its rounds
+        rd.SetCurrentTime(t - en.offsets[i])
+    }
+}
+
+func (en *EnsembleDtctr) Detect(flowID uint32, size uint32, t time.Duration) bool {
+    res := false
+    //every instance sees every packet to keep its counters up to date
+    for i, rd := range en.instances {
+        if rd.Detect(flowID, size, t) {
+            en.detections[i]++
+            res = true
+        }
+    }
+    return res
+}
+
+//the round of the instances, they all share the same schedule
+func (en *EnsembleDtctr) GetRoundDuration() time.Duration {
+    return en.instances[0].GetRoundDuration()
+}
+
+func (en *EnsembleDtctr) GetSize() int {
+    return len(en.instances)
+}
+
+func (en *EnsembleDtctr) GetInstance(i int) *RlfdDtctr {
+    return en.instances[i]
+}
+
+//returns the number of packets flagged by every instance
+func (en *EnsembleDtctr) GetDetections() []uint64 {
+    return append([]uint64(nil), en.detections...)
+}
+
+func (en *EnsembleDtctr) GetBlacklist() *cuckoo.CuckooTable {
+    return nil
+}
+
+func (en *EnsembleDtctr) SetBlacklist(blacklist *cuckoo.CuckooTable) {}
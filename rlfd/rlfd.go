@@ -2,40 +2,54 @@
 package rlfd
 
 import (
+    "crypto/rand"
+    "encoding/binary"
     "time"
     "fmt"
+    "math/bits"
     // "github.com/hosslen/lfd/murmur3"
+    "github.com/hosslen/lfd/aeshash"
     "github.com/hosslen/lfd/cuckoo"
 )
 
 var _ = fmt.Println
 
-// TODO: make the RLFD configurable
 const (
-    //number of counters in a virtual counter node
-    // m = uint32(8)
-    m = uint32(128)
-    //s = log2(m)
-    s = uint32(7)
-    //must hold: s * d < 32
-    //depth of the virtual counter tree
-    d = uint32(4)
+    //default number of counters in a virtual counter node
+    DefaultFanout = uint32(128)
+    //default depth of the virtual counter tree
     //must hold: d >= roundUp(logm(n)) (n = number of flows)
+    DefaultDepth = uint32(4)
+    //length of the secret of the keyed path selection
+    RekeyingKeySize = 16
 )
 
 type counter struct {
     flowID uint32
+    //the path ID of flowID in the round of count
+    pathID uint32
     count uint32
     //indicates if count is current or from last phase
     reset bool
 }
 
 type RlfdDtctr struct {
-    counters [m]counter
-    //threshold for counters, th_rlfd = gamma*t_l + beta must hold
-    th_rlfd uint32
-    //time spent on one level in ns
+    counters []counter
+    //number of counters in a virtual counter node
+    m uint32
+    //s = log2(m), the number of flow ID bits consumed per level
+    s uint32
+    //depth of the virtual counter tree
+    d uint32
+    //time spent on one level in ns, unless a schedule is set
     t_l time.Duration
+    //time spent on every level in ns
+    schedule []time.Duration
+    //the sum of schedule
+    roundLen time.Duration
+    //threshold for counters on every level, th = gamma*schedule[l] + beta
+    //must hold; flows are detected on the lowest level only
+    thresholds []uint32
 
     beta uint32
     gamma float64
@@ -43,7 +57,7 @@ type RlfdDtctr struct {
     //level we are on now
     level uint32
     //to track the maximum counter
-    maxIndex uint8
+    maxIndex uint32
     maxVal uint32
     //time
     now time.Duration
@@ -54,39 +68,154 @@ type RlfdDtctr struct {
     bitmaskIndex uint32
     bitmaskPath uint32
     path uint32
+
+    //maps flow IDs to path IDs, a new mapping every round (nil: the path
+    //ID is the flow ID)
+    aesh *aeshash.AESHasher
+    //number of rounds through the tree so far
+    round uint32
+
+    //called at the end of every level, nil disables tracing
+    traceHook func(*LevelTrace)
+
+    //the lowest level, see bottom.go: the longest displacement chain, the
+    //flows without counter and the number of packets dropped
+    maxChain int
+    stash []counter
+    droppedInserts uint64
+    //scratch space for the candidates of the current flow and of the
+    //flows met while searching a displacement chain
+    candidates []uint32
+    alternatives []uint32
+    chain []chainNode
+    //visited[i] == visitGen if counter i is in chain
+    visited []uint32
+    visitGen uint32
 }
 
-//returns a pointer to a new rlfdDtctr
-func NewRlfdDtctr(beta uint32, gamma float64, t_l time.Duration) *RlfdDtctr {
+//a flow and its count on the lowest level
+type FlowCount struct {
+    FlowID uint32
+    Count uint32
+}
+
+//what RLFD saw on one level
+type LevelTrace struct {
+    Round uint32
+    Level uint32
+    //start of the level
+    Start time.Duration
+    //the subtree of the level, the upper Level*log2(m) bits of the path IDs
+    //of its flows
+    Path uint32
+    //the counter with the most traffic, its subtree is looked at on the
+    //next level (not set on the lowest level)
+    MaxIndex uint32
+    MaxCount uint32
+    //the level is the lowest one, its counters hold single flows
+    Lowest bool
+    //the flows counted on the lowest level
+    Flows []FlowCount
+}
+
+//returns a pointer to a new rlfdDtctr with m counters per node (a power
+//of two) and a tree of depth d, every level consumes log2(m) bits of the
+//flow ID, so log2(m)*d must not exceed 32
+func NewRlfdDtctr(beta uint32, gamma float64, t_l time.Duration,
+        m uint32, d uint32) (*RlfdDtctr, error) {
+    if m < 2 || m & (m - 1) != 0 {
+        return nil, fmt.Errorf("RLFD fanout must be a power of two >= 2, not %d", m)
+    }
+    s := uint32(bits.TrailingZeros32(m))
+    if d < 1 || s*d > 32 {
+        return nil, fmt.Errorf(
+            "RLFD depth %d with fanout %d needs %d flow ID bits, only 32 available",
+            d, m, s*d)
+    }
     rd := &RlfdDtctr{}
+    rd.counters = make([]counter, m)
+    rd.visited = make([]uint32, m)
+    rd.m = m
+    rd.s = s
+    rd.d = d
 
     rd.t_l = t_l
     rd.gamma = gamma
     rd.beta = beta
-    rd.th_rlfd = uint32(gamma*float64(t_l)) + beta
+    schedule := make([]time.Duration, d)
+    for i := range schedule {
+        schedule[i] = t_l
+    }
+    if err := rd.SetSchedule(schedule); err != nil {
+        return nil, err
+    }
     rd.level = 0
-    rd.bitmaskIndex = ((1 << s) - 1) << (32 - s) //(2^s - 1) << (32 - s)
+    rd.bitmaskIndex = (m - 1) << (32 - s) //(2^s - 1) << (32 - s)
     rd.bitmaskPath = 0
     rd.path = 0
     rd.reset = true
+    rd.SetBottomLevel(2, 1, 0)
 
-    return rd
+    return rd, nil
 }
 
 func (rd *RlfdDtctr) GetT_l() time.Duration {
     return rd.t_l
 }
 
+//the threshold of the lowest level
 func (rd *RlfdDtctr) GetTh() uint32 {
-    return rd.th_rlfd
+    return rd.thresholds[rd.d - 1]
+}
+
+// Spend schedule[l] on level l instead of t_l on every level. The
+// threshold of every level follows its duration. Shorter upper levels,
+// where only aggregates are compared, shorten the detection delay. Takes
+// effect with the next level.
+func (rd *RlfdDtctr) SetSchedule(schedule []time.Duration) error {
+    if uint32(len(schedule)) != rd.d {
+        return fmt.Errorf("RLFD schedule has %d levels, the tree %d",
+            len(schedule), rd.d)
+    }
+    thresholds := make([]uint32, rd.d)
+    var roundLen time.Duration
+    for l, dur := range schedule {
+        if dur <= 0 {
+            return fmt.Errorf("level %d of the RLFD schedule lasts %v", l, dur)
+        }
+        thresholds[l] = uint32(rd.gamma*float64(dur)) + rd.beta
+        roundLen += dur
+    }
+    rd.schedule = append([]time.Duration(nil), schedule...)
+    rd.thresholds = thresholds
+    rd.roundLen = roundLen
+    return nil
+}
+
+func (rd *RlfdDtctr) GetSchedule() []time.Duration {
+    return append([]time.Duration(nil), rd.schedule...)
+}
+
+func (rd *RlfdDtctr) GetThresholds() []uint32 {
+    return append([]uint32(nil), rd.thresholds...)
+}
+
+//the time of one round through all levels
+func (rd *RlfdDtctr) GetRoundDuration() time.Duration {
+    return rd.roundLen
 }
 
 func (rd *RlfdDtctr) GetDepth() uint32 {
-    return d
+    return rd.d
 }
 
 func (rd *RlfdDtctr) GetNumCountersPerNode() uint32 {
-    return m
+    return rd.m
+}
+
+//position of the counter index of the current level in the flow ID
+func (rd *RlfdDtctr) indexShift() uint32 {
+    return 32 - rd.s*(rd.level + 1)
 }
 
 func (rd *RlfdDtctr) GetGamma() float64 {
@@ -97,80 +226,62 @@ func (rd *RlfdDtctr) GetBeta() uint32 {
     return rd.beta
 }
 
+// Select the path of a flow through the tree with a keyed hash of the flow
+// ID and the round number instead of the flow ID bits, so that the flows
+// sharing a subtree change from round to round and cannot be predicted
+// without the key. A nil key draws a random secret.
+func (rd *RlfdDtctr) SetRekeying(key []byte) error {
+    if key == nil {
+        key = make([]byte, RekeyingKeySize)
+        if _, err := rand.Read(key); err != nil {
+            return err
+        }
+    }
+    if len(key) != RekeyingKeySize {
+        return fmt.Errorf("RLFD rekeying key must be %d bytes, not %d",
+            RekeyingKeySize, len(key))
+    }
+    rd.aesh = aeshash.NewAESHasher(key)
+    return nil
+}
+
+func (rd *RlfdDtctr) GetRekeying() bool {
+    return rd.aesh != nil
+}
+
+//the ID whose bits select the path of flowID in the current round
+func (rd *RlfdDtctr) pathID(flowID uint32) uint32 {
+    if rd.aesh == nil {
+        return flowID
+    }
+    var input [16]byte
+    binary.LittleEndian.PutUint32(input[:4], flowID)
+    binary.LittleEndian.PutUint32(input[4:8], rd.round)
+    return rd.aesh.Hash_uint32(&input)
+}
+
 func (rd *RlfdDtctr) SetCurrentTime(t time.Duration) {
     rd.now = t
 }
 
 func (rd *RlfdDtctr) Detect(flowID uint32, size uint32, t time.Duration) bool {
-    //check if we advance one level
-    diff := t - rd.now
-    if (diff > rd.t_l) {
-        rd.now += rd.t_l*(diff / rd.t_l)
-        if (rd.level == d - 1) {
-            rd.bitmaskIndex = 0xe0000000
-            rd.bitmaskPath = 0
-            rd.level = 0
-            rd.path = 0
-            // murmur3.ResetSeed()
-        } else {
-            temp1 := 29 - (rd.level * 3)
-            temp2 := uint32(0x7 << temp1)
-            rd.bitmaskIndex >>= 3
-            rd.bitmaskPath = rd.bitmaskPath | temp2
-            rd.level++
-            rd.path = rd.path | (uint32(rd.maxIndex) << temp1)
-        }
-        rd.maxVal = 0
-        if rd.numCountersReseted < m {
-            for i := uint32(0); i < m; i++ {
-                rd.counters[i].reset = rd.reset
-            }
-        }
-        rd.numCountersReseted = 0
-        rd.reset = !rd.reset
+    //check if we advance one or more levels, a level ends at
+    //rd.now + rd.schedule[rd.level], which is the start of the next one
+    if (t - rd.now >= rd.schedule[rd.level]) {
+        rd.advance(t)
     }
 
     //is the right virtual counter loaded?
-    if (flowID & rd.bitmaskPath) == rd.path {
-        index := uint8((flowID & rd.bitmaskIndex) >> (29 - (3 * rd.level)))
+    id := rd.pathID(flowID)
+    if (id & rd.bitmaskPath) == rd.path {
+        index := (id & rd.bitmaskIndex) >> rd.indexShift()
         c := &rd.counters[index]
 
 
 
         //are we on the lowest level?
-        if rd.level == d - 1 {
-            //do cuckoo hashing
-            var alt bool
-            altIndex := (flowID & 0x38) >> 3
-            if (c.flowID == flowID && c.reset == rd.reset) {
-                c.count += size
-            } else if c2 := &rd.counters[altIndex]; c2.flowID == flowID && c2.reset == rd.reset {
-                c2.count += size
-                alt = true
-            } else if c.reset != rd.reset {
-                c.count = size
-                c.flowID = flowID
-                c.reset = rd.reset
-                rd.numCountersReseted++
-            } else if c2 := &rd.counters[((c.flowID & 0x38) >> 3)]; c2.reset != rd.reset {
-                c2.count = c.count
-                c2.flowID = c.flowID
-                c2.reset = rd.reset
-                rd.numCountersReseted++
-                c.count = size
-                c.flowID = flowID
-            } else {
-                return false
-            }
-
-            //check threshold
-            if size > rd.th_rlfd {
-                return true
-            } else if c.count > rd.th_rlfd && !alt {
-                return true
-            } else if alt && rd.counters[altIndex].count > rd.th_rlfd {
-                return true
-            }
+        if rd.level == rd.d - 1 {
+            return rd.countBottom(flowID, id, size)
         //we are not on the lowest level
         } else {
             if c.reset != rd.reset {
@@ -190,6 +301,89 @@ func (rd *RlfdDtctr) Detect(flowID uint32, size uint32, t time.Duration) bool {
     return false
 }
 
+//moves on to the level at time t, as if each level had passed on its own.
+//No packets were seen on all levels but the first, so their counters stay
+//empty and their path follows the previous maximum.
+func (rd *RlfdDtctr) advance(t time.Duration) {
+    rd.advanceLevel()
+    //whole rounds of empty levels lead to the same state, skip all but two
+    //(they are not traced)
+    if rounds := (t - rd.now)/rd.roundLen; rounds > 2 {
+        skip := rounds - 2
+        rd.round += uint32(skip)
+        if uint64(skip)*uint64(rd.d) % 2 == 1 {
+            rd.reset = !rd.reset
+        }
+        rd.now += rd.roundLen*skip
+    }
+    for t - rd.now >= rd.schedule[rd.level] {
+        rd.advanceLevel()
+    }
+}
+
+//moves on to the next level, or to the top of the next round
+func (rd *RlfdDtctr) advanceLevel() {
+    if rd.traceHook != nil {
+        rd.traceHook(rd.levelTrace())
+    }
+    rd.now += rd.schedule[rd.level]
+    if (rd.level == rd.d - 1) {
+        rd.bitmaskIndex = (rd.m - 1) << (32 - rd.s)
+        rd.bitmaskPath = 0
+        rd.level = 0
+        rd.path = 0
+        //a new round, with rekeying the flows get new paths
+        rd.round++
+    } else {
+        shift := rd.indexShift()
+        rd.bitmaskIndex >>= rd.s
+        rd.bitmaskPath = rd.bitmaskPath | (rd.m - 1) << shift
+        rd.level++
+        rd.path = rd.path | (rd.maxIndex << shift)
+    }
+    rd.maxVal = 0
+    rd.stash = rd.stash[:0]
+    //counters not written on this level still carry the current reset
+    //flag, flip them so that all counters are regarded as zero
+    if rd.numCountersReseted < rd.m {
+        for i := uint32(0); i < rd.m; i++ {
+            rd.counters[i].reset = rd.reset
+        }
+    }
+    rd.numCountersReseted = 0
+    rd.reset = !rd.reset
+}
+
+// Calls hook with the state of every level when the level ends, to follow
+// how RLFD zooms in on large flows. nil disables tracing.
+func (rd *RlfdDtctr) SetTraceHook(hook func(*LevelTrace)) {
+    rd.traceHook = hook
+}
+
+//the state of the current level
+func (rd *RlfdDtctr) levelTrace() *LevelTrace {
+    lt := &LevelTrace{
+        Round: rd.round,
+        Level: rd.level,
+        Start: rd.now,
+        Path: rd.path,
+        Lowest: rd.level == rd.d - 1,
+    }
+    if !lt.Lowest {
+        lt.MaxIndex = rd.maxIndex
+        lt.MaxCount = rd.maxVal
+        return lt
+    }
+    for i := range rd.counters {
+        if c := &rd.counters[i]; c.reset == rd.reset {
+            lt.Flows = append(lt.Flows, FlowCount{c.flowID, c.count})
+        }
+    }
+    for _, c := range rd.stash {
+        lt.Flows = append(lt.Flows, FlowCount{c.flowID, c.count})
+    }
+    return lt
+}
 
 func (rd *RlfdDtctr) GetBlacklist() *cuckoo.CuckooTable {
     return nil
@@ -2,24 +2,39 @@ package rlfd
 
 import (
     "math/rand"
+    "reflect"
     "testing"
     "time"
 
     "fmt"
 )
 
-const max = uint32(4294967295)
+const (
+    max = uint32(4294967295)
+    //the tree used in the tests: 8 counters per node, 7 levels
+    m = uint32(8)
+    s = uint32(3)
+    d = uint32(7)
+)
 
 var (
     beta = uint32(500)
-    gamma = uint32(200)
+    gamma = float64(200)
     t_l = time.Duration(500)
     _ = fmt.Println
 )
 
+func newTestDtctr(t *testing.T) *RlfdDtctr {
+    detector, err := NewRlfdDtctr(beta, gamma, t_l, m, d)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return detector
+}
+
 //insert a simple package
 func TestBasicInsert(t *testing.T) {
-    detector := NewRlfdDtctr(beta, gamma, t_l)
+    detector := newTestDtctr(t)
     flowID := rand.Uint32()
     size := uint32(500)
     timestamp := time.Duration(0)
@@ -40,7 +55,7 @@ func TestBasicInsert(t *testing.T) {
 
 //test if level is raised correctly
 func TestLevelRaising(t *testing.T) {
-    detector := NewRlfdDtctr(beta, gamma, t_l)
+    detector := newTestDtctr(t)
     flowID := rand.Uint32() & ((^uint32(0)) >> s)
     size := uint32(500)
     timestamp := t_l + 1
@@ -62,9 +77,33 @@ func TestLevelRaising(t *testing.T) {
     // fmt.Println(detector.counters)
 }
 
+//a packet at the end of a level belongs to the next one, whether the
+//level is left by that packet or after a gap of several levels
+func TestLevelBoundary(t *testing.T) {
+    detector := newTestDtctr(t)
+    detector.Detect(0, 100, 0)
+    detector.Detect(0, 100, t_l - 1)
+    if detector.level != 0 {
+        t.Errorf("level is %d before the end of level 0, should be 0", detector.level)
+    }
+    detector.Detect(0, 100, t_l)
+    if detector.level != 1 || detector.now != t_l {
+        t.Errorf("level is %d from %d at the end of level 0, should be 1 from %d",
+            detector.level, detector.now, t_l)
+    }
+
+    detector = newTestDtctr(t)
+    detector.Detect(0, 100, 0)
+    detector.Detect(0, 100, 3*t_l)
+    if detector.level != 3 || detector.now != 3*t_l {
+        t.Errorf("level is %d from %d at the end of level 2, should be 3 from %d",
+            detector.level, detector.now, 3*t_l)
+    }
+}
+
 //insert two simple packages
 func TestInsertTwo(t *testing.T) {
-    detector := NewRlfdDtctr(beta, gamma, t_l)
+    detector := newTestDtctr(t)
     flowID := uint32(0x20000000)
     size := uint32(500)
     timestamp := time.Duration(0)
@@ -85,7 +124,7 @@ func TestInsertTwo(t *testing.T) {
 
 
 func TestSetPathCorrectly(t *testing.T) {
-    detector := NewRlfdDtctr(beta, gamma, t_l)
+    detector := newTestDtctr(t)
     flowIDs := [7]uint32{0x20000000, 0x28000000, 0x29800000, 0x29C00000, 0x29CA0000, 0x29CB8000, 0x29CBB800}
     sizes := [7]uint32{100, 200, 300, 400, 500, 600, 700}
     timestamps := [7]time.Duration{0, t_l + 1, 2*t_l + 1, 3*t_l + 1, 4*t_l + 1, 5*t_l + 1, 6*t_l + 1}
@@ -105,7 +144,7 @@ func TestSetPathCorrectly(t *testing.T) {
 }
 
 func TestSameFlowOverManyLevelsAlwaysSameBucket(t *testing.T) {
-    detector := NewRlfdDtctr(beta, gamma, t_l)
+    detector := newTestDtctr(t)
     flowID := uint32(0x24924800)
     size := uint32(100)
     timestamps := [7]time.Duration{0, t_l + 1, 2*t_l + 1, 3*t_l + 1, 4*t_l + 1, 5*t_l + 1, 6*t_l + 1}
@@ -136,7 +175,7 @@ func TestSameFlowOverManyLevelsAlwaysSameBucket(t *testing.T) {
 }
 
 func TestDetectFlow(t *testing.T) {
-    detector := NewRlfdDtctr(beta, gamma, t_l)
+    detector := newTestDtctr(t)
     flowID := uint32(0x24924800)
     size := uint32(100600)
     timestamps := [7]time.Duration{0, t_l + 1, 2*t_l + 1, 3*t_l + 1, 4*t_l + 1, 5*t_l + 1, 6*t_l + 1}
@@ -179,18 +218,462 @@ func TestDetectFlow(t *testing.T) {
 
 func TestTime(t *testing.T) {
     now := 7*t_l + 5
-    detector := NewRlfdDtctr(beta, gamma, t_l)
+    detector := newTestDtctr(t)
     detector.SetCurrentTime(now)
     detector.Detect(0, 0, now + 2*t_l + 1)
     detector.Detect(0, 0, now + 2*t_l + 2)
-    if detector.level != 1 {
+    if detector.level != 2 {
         t.Errorf("Detect failed: level is not set correctly, should be %d but is %d.\n",
-            1, detector.level)
+            2, detector.level)
+    }
+}
+
+
+
+
+
+
+func TestFanoutAndDepth(t *testing.T) {
+    invalid := [][2]uint32{{0, 4}, {1, 4}, {12, 4}, {128, 5}, {8, 0}, {16, 9}}
+    for _, c := range invalid {
+        if _, err := NewRlfdDtctr(beta, gamma, t_l, c[0], c[1]); err == nil {
+            t.Errorf("fanout %d and depth %d accepted", c[0], c[1])
+        }
+    }
+
+    //16x6 consumes the upper 24 bits of the flow ID, 4 per level
+    detector, err := NewRlfdDtctr(beta, gamma, t_l, 16, 6)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if detector.GetNumCountersPerNode() != 16 || detector.GetDepth() != 6 {
+        t.Errorf("detector has fanout %d and depth %d, should be 16 and 6",
+            detector.GetNumCountersPerNode(), detector.GetDepth())
+    }
+    flowID := uint32(0xabcdef12)
+    for i := uint32(0); i < 6; i++ {
+        detector.Detect(flowID, 100, time.Duration(i)*(t_l + 1))
+        expectedPath := uint32(0)
+        if i > 0 {
+            expectedPath = flowID &^ (max >> (4*i))
+        }
+        if detector.path != expectedPath {
+            t.Errorf("path on level %d is 0x%x, should be 0x%x", i, detector.path, expectedPath)
+        }
+        index := (flowID >> (28 - 4*i)) & 0xf
+        if detector.counters[index].count != 100 {
+            t.Errorf("counter %d on level %d has count %d, should be 100",
+                index, i, detector.counters[index].count)
+        }
+    }
+    if _, err := NewRlfdDtctr(beta, gamma, t_l, 2, 32); err != nil {
+        t.Errorf("fanout 2 and depth 32 rejected: %v", err)
+    }
+}
+
+func TestRekeying(t *testing.T) {
+    detector := newTestDtctr(t)
+    if err := detector.SetRekeying([]byte("short")); err == nil {
+        t.Errorf("key of 5 bytes accepted")
+    }
+    if err := detector.SetRekeying([]byte("ABCDEFGHIJKLMNOP")); err != nil {
+        t.Fatal(err)
+    }
+    if !detector.GetRekeying() {
+        t.Errorf("rekeying not enabled")
+    }
+
+    //the flow is counted at the index given by its path ID
+    flowID := uint32(0x20000000)
+    id := detector.pathID(flowID)
+    detector.Detect(flowID, 500, 0)
+    if c := detector.counters[id >> (32 - s)].count; c != 500 {
+        t.Errorf("counter of the path ID has count %d, should be 500", c)
+    }
+
+    //flows that share the top level subtree by their IDs get different
+    //paths, and the paths change from round to round
+    sameSubtree, samePath := 0, 0
+    for i := uint32(0); i < 64; i++ {
+        detector.round = 0
+        a := detector.pathID(flowID | i)
+        detector.round = 1
+        if detector.pathID(flowID | i) == a {
+            samePath++
+        }
+        if a >> (32 - s) == id >> (32 - s) {
+            sameSubtree++
+        }
+    }
+    if sameSubtree > 32 || samePath > 0 {
+        t.Errorf("%d of 64 flows share the subtree, %d keep their path", sameSubtree, samePath)
+    }
+
+    //a new round starts after d levels
+    detector.round = 0
+    for i := uint32(1); i <= d; i++ {
+        detector.Detect(flowID, 500, time.Duration(i)*(t_l + 1))
+    }
+    if detector.round != 1 {
+        t.Errorf("round is %d after %d levels, should be 1", detector.round, d)
+    }
+}
+
+//a silence of many levels leads to the same state as stepping through
+//the levels one by one
+func TestLongSilence(t *testing.T) {
+    gaps := []uint64{2, 6, 7, 8, 13, 14, 15, 21, 22, 100, 1000, 1000001}
+    for _, gap := range gaps {
+        detector := newTestDtctr(t)
+        reference := newTestDtctr(t)
+        r := rand.New(rand.NewSource(int64(gap)))
+        for i := 0; i < 300; i++ {
+            flowID, size := r.Uint32(), uint32(r.Intn(1500))
+            ts := time.Duration(i)*(3*t_l/100)
+            detector.Detect(flowID, size, ts)
+            reference.Detect(flowID, size, ts)
+        }
+
+        level := uint64(detector.level)
+        ts := reference.now + time.Duration(gap)*t_l + 1
+        detector.Detect(0x24924800, 100, ts)
+        for i := uint64(0); i < gap; i++ {
+            reference.advanceLevel()
+        }
+        reference.Detect(0x24924800, 100, ts)
+        if !reflect.DeepEqual(detector, reference) {
+            t.Errorf("state after %d silent levels differs: level %d path 0x%x round %d, " +
+                "should be level %d path 0x%x round %d", gap, detector.level,
+                detector.path, detector.round, reference.level, reference.path,
+                reference.round)
+        }
+        if detector.level != uint32((level + gap) % uint64(d)) {
+            t.Errorf("level %d after %d silent levels, should be %d",
+                detector.level, gap, (level + gap) % uint64(d))
+        }
+    }
+}
+
+//counts from before a silence are forgotten
+func TestCountsForgottenAfterSilence(t *testing.T) {
+    detector := newTestDtctr(t)
+    flowID := uint32(0x20000000)
+    detector.Detect(flowID, 500, 0)
+    for _, gap := range []time.Duration{2, 3, 14, 15} {
+        now := detector.now
+        detector.Detect(flowID, 500, now + gap*t_l + 1)
+        //the flow went down the path of counter 0, so it is counted on
+        //the top level only
+        if detector.level == 0 {
+            index := flowID >> (32 - s)
+            if c := detector.counters[index].count; c != 500 {
+                t.Errorf("count is %d after %d silent levels, should be 500", c, gap)
+            }
+        }
+        for i := range detector.counters {
+            c := &detector.counters[i]
+            if c.reset == detector.reset && c.count != 500 {
+                t.Errorf("counter %d holds %d after %d silent levels", i, c.count, gap)
+            }
+        }
+    }
+}
+
+func TestTraceHook(t *testing.T) {
+    detector := newTestDtctr(t)
+    var traces []*LevelTrace
+    detector.SetTraceHook(func(lt *LevelTrace) {
+        traces = append(traces, lt)
+    })
+    flowID := uint32(0x24924800)
+    expectedPaths := [7]uint32{0x0, 0x20000000, 0x24000000, 0x24800000, 0x24900000, 0x24920000, 0x24924000}
+    for i := 0; i < 8; i++ {
+        detector.Detect(flowID, 100, time.Duration(i)*(t_l + 1))
+    }
+    if len(traces) != 7 {
+        t.Fatalf("%d levels traced, should be 7", len(traces))
+    }
+    for i, lt := range traces {
+        if lt.Round != 0 || lt.Level != uint32(i) || lt.Path != expectedPaths[i] ||
+                lt.Start != time.Duration(i)*t_l {
+            t.Errorf("trace %d is round %d level %d path 0x%x start %v", i,
+                lt.Round, lt.Level, lt.Path, lt.Start)
+        }
+        if lt.Lowest != (i == 6) {
+            t.Errorf("level %d is lowest: %t", i, lt.Lowest)
+        }
+        if i < 6 && (lt.MaxIndex != 1 || lt.MaxCount != 100 || lt.Flows != nil) {
+            t.Errorf("level %d has maximum %d in counter %d and flows %v, " +
+                "should have 100 in counter 1", i, lt.MaxCount, lt.MaxIndex, lt.Flows)
+        }
+    }
+    flows := traces[6].Flows
+    if len(flows) != 1 || flows[0] != (FlowCount{flowID, 100}) {
+        t.Errorf("lowest level has flows %v, should have 0x%x with 100", flows, flowID)
+    }
+}
+
+func TestEnsembleFlagsIfAnyInstanceFlags(t *testing.T) {
+    if _, err := NewEnsembleDtctr(0, beta, gamma, t_l, m, d, false); err == nil {
+        t.Errorf("ensemble without instances accepted")
+    }
+
+    //with a single level every flow is counted by every instance
+    ensemble, err := NewEnsembleDtctr(3, beta, gamma, t_l, m, 1, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    th := ensemble.GetInstance(0).GetTh()
+    if ensemble.Detect(0x20000000, th/2, 0) {
+        t.Errorf("flow flagged below the threshold")
+    }
+    if !ensemble.Detect(0x20000000, th/2 + 1, 1) {
+        t.Errorf("flow not flagged above the threshold")
+    }
+    detections := ensemble.GetDetections()
+    if len(detections) != 3 {
+        t.Fatalf("%d instances report detections, should be 3", len(detections))
+    }
+    for i, n := range detections {
+        if n != 1 {
+            t.Errorf("instance %d flagged %d packets, should be 1", i, n)
+        }
+    }
+}
+
+func TestEnsembleStaggered(t *testing.T) {
+    ensemble, err := NewEnsembleDtctr(int(d), beta, gamma, t_l, m, d, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    now := 3*time.Duration(d)*t_l
+    ensemble.SetCurrentTime(now)
+    ensemble.Detect(0, 100, now + 1)
+    //instance i is i levels ahead
+    for i := 0; i < ensemble.GetSize(); i++ {
+        if level := ensemble.GetInstance(i).level; level != uint32(i) {
+            t.Errorf("instance %d is on level %d, should be on %d", i, level, i)
+        }
+    }
+
+    ensemble, _ = NewEnsembleDtctr(int(d), beta, gamma, t_l, m, d, false)
+    ensemble.Detect(0, 100, now + 1)
+    for i := 0; i < ensemble.GetSize(); i++ {
+        if level := ensemble.GetInstance(i).level; level != 0 {
+            t.Errorf("instance %d is on level %d without staggering", i, level)
+        }
+    }
+}
+
+func TestSchedule(t *testing.T) {
+    detector, err := NewRlfdDtctr(beta, gamma, t_l, m, 3)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := detector.SetSchedule([]time.Duration{t_l, t_l}); err == nil {
+        t.Errorf("schedule of 2 levels accepted for a tree of 3")
+    }
+    if err := detector.SetSchedule([]time.Duration{t_l, 0, t_l}); err == nil {
+        t.Errorf("level of 0ns accepted")
+    }
+    schedule := []time.Duration{t_l/2, t_l, 4*t_l}
+    if err := detector.SetSchedule(schedule); err != nil {
+        t.Fatal(err)
+    }
+    ths := detector.GetThresholds()
+    for l, dur := range schedule {
+        if th := uint32(gamma*float64(dur)) + beta; ths[l] != th {
+            t.Errorf("threshold of level %d is %d, should be %d", l, ths[l], th)
+        }
+    }
+    if detector.GetTh() != ths[2] || detector.GetRoundDuration() != 11*t_l/2 {
+        t.Errorf("threshold %d and round %v, should be %d and %v",
+            detector.GetTh(), detector.GetRoundDuration(), ths[2], 11*t_l/2)
+    }
+
+    //the levels start at 0, t_l/2, 3t_l/2, 11t_l/2, ...
+    starts := []time.Duration{0, t_l/2, 3*t_l/2, 11*t_l/2, 6*t_l}
+    for i, start := range starts {
+        detector.Detect(0x24924800, 100, start + 1)
+        if detector.level != uint32(i % 3) || detector.now != start {
+            t.Errorf("at %v: level %d started at %v, should be level %d started at %v",
+                start + 1, detector.level, detector.now, i % 3, start)
+        }
+    }
+
+    //a flow on the lowest level is detected above the threshold of that
+    //level only
+    detector.Detect(0x24924800, 100, 7*t_l + 1)
+    if detector.level != 2 {
+        t.Fatalf("on level %d, should be on the lowest", detector.level)
+    }
+    if detector.Detect(0x24924800, ths[2] - 100, 7*t_l + 2) {
+        t.Errorf("flow detected at the threshold")
+    }
+    if !detector.Detect(0x24924800, 1, 7*t_l + 3) {
+        t.Errorf("flow not detected above the threshold")
+    }
+
+    //long silences match stepping through the levels
+    for _, gap := range []time.Duration{3*t_l, 17*t_l, 1000*t_l + 7, 1000003*t_l} {
+        reference := *detector
+        reference.counters = append([]counter(nil), detector.counters...)
+        ts := detector.now + gap
+        detector.Detect(0x24924800, 100, ts)
+        if ts - reference.now > reference.schedule[reference.level] {
+            reference.advanceLevel()
+            for ts - reference.now >= reference.schedule[reference.level] {
+                reference.advanceLevel()
+            }
+        }
+        reference.Detect(0x24924800, 100, ts)
+        if !reflect.DeepEqual(*detector, reference) {
+            t.Errorf("state after a silence of %v differs: level %d round %d, " +
+                "should be level %d round %d", gap, detector.level, detector.round,
+                reference.level, reference.round)
+        }
     }
 }
 
+//a flow ID on the only level of a tree of depth 1 with candidates index
+//and alt, unique tells flows with the same candidates apart
+func bottomFlow(index, alt, unique uint32) uint32 {
+    return index << 29 | unique << 6 | alt << 3
+}
 
+func TestBottomLevel(t *testing.T) {
+    detector, err := NewRlfdDtctr(beta, gamma, t_l, m, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, c := range [][3]int{{0, 1, 0}, {MaxSlots + 1, 1, 0}, {2, -1, 0}, {2, 1, -1}} {
+        if detector.SetBottomLevel(c[0], c[1], c[2]) == nil {
+            t.Errorf("slots %d, chain %d and stash %d accepted", c[0], c[1], c[2])
+        }
+    }
 
+    //two flows fill both candidates, the third is dropped
+    x, y, z := bottomFlow(0, 1, 1), bottomFlow(0, 1, 2), bottomFlow(0, 1, 3)
+    detector.Detect(x, 100, 0)
+    detector.Detect(y, 100, 0)
+    detector.Detect(z, 100, 0)
+    if detector.counters[0].flowID != x || detector.counters[1].flowID != y {
+        t.Errorf("counters hold 0x%x and 0x%x, should hold 0x%x and 0x%x",
+            detector.counters[0].flowID, detector.counters[1].flowID, x, y)
+    }
+    if detector.GetDroppedInserts() != 1 {
+        t.Errorf("%d inserts dropped, should be 1", detector.GetDroppedInserts())
+    }
 
+    //a stash takes the third flow, which is still detected
+    detector, _ = NewRlfdDtctr(beta, gamma, t_l, m, 1)
+    detector.SetBottomLevel(2, 1, 1)
+    detector.Detect(x, 100, 0)
+    detector.Detect(y, 100, 0)
+    detector.Detect(z, 100, 0)
+    detector.Detect(bottomFlow(0, 1, 4), 100, 0)
+    if len(detector.stash) != 1 || detector.stash[0].flowID != z {
+        t.Errorf("stash holds %v, should hold 0x%x", detector.stash, z)
+    }
+    if detector.GetDroppedInserts() != 1 {
+        t.Errorf("%d inserts dropped, should be 1", detector.GetDroppedInserts())
+    }
+    if !detector.Detect(z, detector.GetTh(), 0) {
+        t.Errorf("flow in the stash not detected")
+    }
+    detector.Detect(x, 100, t_l + 1)
+    if len(detector.stash) != 0 {
+        t.Errorf("stash not emptied at the end of the level")
+    }
 
+    //w moves on to its alternative to make room for n, which takes a chain
+    //of two moves
+    w, n := bottomFlow(1, 2, 5), bottomFlow(2, 3, 6)
+    for chain := 1; chain <= 2; chain++ {
+        detector, _ = NewRlfdDtctr(beta, gamma, t_l, m, 1)
+        detector.SetBottomLevel(2, chain, 0)
+        detector.Detect(x, 100, 0)
+        detector.Detect(w, 100, 0)
+        detector.Detect(n, 100, 0)
+        detector.Detect(y, 200, 0)
+        if chain == 1 {
+            if detector.GetDroppedInserts() != 1 {
+                t.Errorf("%d inserts dropped with chains of 1, should be 1",
+                    detector.GetDroppedInserts())
+            }
+            continue
+        }
+        want := []uint32{x, y, w, n}
+        for i, f := range want {
+            if c := detector.counters[i]; c.flowID != f || c.reset != detector.reset {
+                t.Errorf("counter %d holds 0x%x, should hold 0x%x", i, c.flowID, f)
+            }
+        }
+        if detector.counters[1].count != 200 || detector.counters[2].count != 100 {
+            t.Errorf("counts %d and %d, should be 200 and 100",
+                detector.counters[1].count, detector.counters[2].count)
+        }
+        if detector.GetDroppedInserts() != 0 {
+            t.Errorf("%d inserts dropped with chains of 2", detector.GetDroppedInserts())
+        }
+    }
 
+    //more slots give the third flow a hashed candidate
+    detector, _ = NewRlfdDtctr(beta, gamma, t_l, m, 1)
+    detector.SetBottomLevel(4, 0, 0)
+    detector.Detect(x, 100, 0)
+    detector.Detect(y, 100, 0)
+    detector.Detect(z, 100, 0)
+    if detector.GetDroppedInserts() != 0 {
+        t.Errorf("%d inserts dropped with 4 slots", detector.GetDroppedInserts())
+    }
+}
+
+func TestTwinRlfd(t *testing.T) {
+    for _, c := range [][4]float64{{0, 0.0125, 3, 1}, {0.00125, 0.001, 3, 1},
+            {0.00125, 0.0125, 0, 1}, {0.00125, 0.0125, 3, 0}} {
+        if _, err := NewTwinRlfdDtctr(6056, c[0], c[3], c[1], c[2], 128, 4); err == nil {
+            t.Errorf("gamma %g, gamma_h %g, attacker factor %g and t_l factor %g accepted",
+                c[0], c[1], c[2], c[3])
+        }
+    }
+
+    //the first RLFD has levels of beta/gamma, the second RLFD has levels of
+    //2*4*0.0125/(3*0.00125) = 26.67 times those, the fraction must not be
+    //lost
+    twin, err := NewTwinRlfdDtctr(6056, 0.00125, 1, 0.0125, 3, 128, 4)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if t_l1 := twin.GetRlfd1().GetT_l(); t_l1 != 4844800 {
+        t.Errorf("first RLFD has levels of %v, should be 4.8448ms", t_l1)
+    }
+    if t_l2 := twin.GetRlfd2().GetT_l(); t_l2 != 129194666 {
+        t.Errorf("second RLFD has levels of %v, should be 129.194666ms", t_l2)
+    }
+
+    //the t_l factor stretches the levels of both RLFDs
+    twin, err = NewTwinRlfdDtctr(6056, 0.00125, 2, 0.0125, 3, 128, 4)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if t_l1 := twin.GetRlfd1().GetT_l(); t_l1 != 2*4844800 {
+        t.Errorf("first RLFD has levels of %v, should be 9.6896ms", t_l1)
+    }
+    if t_l2 := twin.GetRlfd2().GetT_l(); t_l2 != 258389333 {
+        t.Errorf("second RLFD has levels of %v, should be 258.389333ms", t_l2)
+    }
+
+    //a flow above the threshold of both RLFDs on the lowest level
+    twin, _ = NewTwinRlfdDtctr(500, 200, 1, 1000, 2, m, 1)
+    if !twin.Detect(0x20000000, twin.GetRlfd2().GetTh() + 1, 0) {
+        t.Errorf("flow not detected")
+    }
+    if twin.Rd1Detected != 1 || twin.Rd2Detected != 1 {
+        t.Errorf("RLFDs detected %d and %d packets, should be 1 and 1",
+            twin.Rd1Detected, twin.Rd2Detected)
+    }
+    if twin.Detect(0x40000000, twin.GetRlfd1().GetTh(), 1) {
+        t.Errorf("flow detected at the threshold")
+    }
+}
@@ -0,0 +1,94 @@
+// Twin-RLFD, the pair of RLFDs used by CLEF
+package rlfd
+
+import (
+    "fmt"
+    "time"
+
+    "github.com/hosslen/lfd/cuckoo"
+)
+
+//two RLFDs with different round lengths: the first catches flows above
+//the flow spec within rounds of t_l per level, the second, with
+//longer levels, catches the flows that stay just below EARDet's gamma_h
+//(Theorem 5.6 of the CLEF paper). A flow is flagged if one of them flags
+//it.
+type TwinRlfdDtctr struct {
+    rlfd1 *RlfdDtctr
+    rlfd2 *RlfdDtctr
+
+    //number of packets flagged by either RLFD
+    Rd1Detected uint64
+    Rd2Detected uint64
+}
+
+//returns a pointer to a new Twin-RLFD for the flow spec gamma*t + beta,
+//both RLFDs with m counters per node and depth d. The levels of the first
+//RLFD last t_l = tlFactor*beta/gamma (1 as in the CLEF paper). Flows of
+//attackerFactor times gamma or more and below gamma_h are detected by the
+//second RLFD, whose levels last 2*d*gamma_h/(attackerFactor*gamma) * t_l
+//(Theorem 5.6 of the CLEF paper).
+func NewTwinRlfdDtctr(beta uint32, gamma float64, tlFactor float64,
+        gamma_h float64, attackerFactor float64,
+        m uint32, d uint32) (*TwinRlfdDtctr, error) {
+    if !(gamma > 0 && gamma_h > gamma && attackerFactor > 0 && tlFactor > 0) {
+        return nil, fmt.Errorf(
+            "need 0 < gamma < gamma_h, attacker flow factor > 0 and t_l factor > 0, " +
+            "have %g, %g, %g and %g", gamma, gamma_h, attackerFactor, tlFactor)
+    }
+    t_l := time.Duration(tlFactor*float64(beta)/gamma)
+    t_l2 := float64(t_l) * 2*float64(d)*gamma_h/(attackerFactor*gamma)
+    td := &TwinRlfdDtctr{}
+    var err error
+    td.rlfd1, err = NewRlfdDtctr(beta, gamma, t_l, m, d)
+    if err != nil {
+        return nil, err
+    }
+    td.rlfd2, err = NewRlfdDtctr(beta, gamma, time.Duration(t_l2), m, d)
+    if err != nil {
+        return nil, err
+    }
+    return td, nil
+}
+
+//the RLFD with levels of t_l
+func (td *TwinRlfdDtctr) GetRlfd1() *RlfdDtctr {
+    return td.rlfd1
+}
+
+//the RLFD with the long levels
+func (td *TwinRlfdDtctr) GetRlfd2() *RlfdDtctr {
+    return td.rlfd2
+}
+
+//the round of the RLFD with the long levels
+func (td *TwinRlfdDtctr) GetRoundDuration() time.Duration {
+    if td.rlfd2.GetRoundDuration() > td.rlfd1.GetRoundDuration() {
+        return td.rlfd2.GetRoundDuration()
+    }
+    return td.rlfd1.GetRoundDuration()
+}
+
+func (td *TwinRlfdDtctr) SetCurrentTime(t time.Duration) {
+    td.rlfd1.SetCurrentTime(t)
+    td.rlfd2.SetCurrentTime(t)
+}
+
+func (td *TwinRlfdDtctr) Detect(flowID uint32, size uint32, t time.Duration) bool {
+    //both RLFDs see every packet to keep their counters up to date
+    r1 := td.rlfd1.Detect(flowID, size, t)
+    r2 := td.rlfd2.Detect(flowID, size, t)
+    if r1 {
+        td.Rd1Detected++
+    }
+    if r2 {
+        td.Rd2Detected++
+    }
+    return r1 || r2
+}
+
+func (td *TwinRlfdDtctr) GetBlacklist() *cuckoo.CuckooTable {
+    return nil
+}
+
+func (td *TwinRlfdDtctr) SetBlacklist(blacklist *cuckoo.CuckooTable) {}